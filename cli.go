@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/palicao/docker-executor/lib"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// validate checks the config file, printing all the errors found, as text or
+// as a json array for linting tools.
+func validate(args []string) int {
+	fs := newCommand("validate", "")
+	configFile := configFlag(fs)
+	format := fs.String("format", "text", "output format: text or json")
+	parseCommand(fs, args, 0)
+
+	config, err := lib.GetConfigFromFile(*configFile)
+	errs, ok := err.(lib.ConfigErrors)
+	if err != nil && !ok {
+		errs = lib.ConfigErrors{{File: *configFile, Message: err.Error()}}
+	}
+
+	if *format == "json" {
+		if errs == nil {
+			errs = lib.ConfigErrors{}
+		}
+		js, _ := json.MarshalIndent(errs, "", "  ")
+		fmt.Println(string(js))
+	} else {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		if len(errs) == 0 {
+			fmt.Printf("%s is valid, %d jobs configured\n", *configFile, len(config.Jobs))
+		}
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runOnce runs a job once, writing its output to stdout, and exits with its
+// exit code. The jobs running after it are not run.
+func runOnce(args []string) int {
+	fs := newCommand("run", "<job>")
+	configFile := configFlag(fs)
+	logLevel, logFormat := loggingFlags(fs)
+	jobName := parseCommand(fs, args, 1)[0]
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid logging options")
+	}
+
+	config, err := lib.GetConfigFromFile(*configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("error reading config")
+	}
+	if _, ok := config.Jobs[jobName]; !ok {
+		logrus.Fatalf("unknown job %s", jobName)
+	}
+
+	cli, err := newDockerClient()
+	if err != nil {
+		logrus.WithError(err).Fatal("error creating client")
+	}
+
+	// runs are kept in memory, not to interfere with the state of a daemon
+	store, _ := lib.NewStore("")
+	detachAfter(config, jobName)
+	keepLocal(config)
+	runner := newRunner(config, lib.NewDockerApi(cli), store, os.Stdout)
+
+	run, _, err := runner.Run(jobName, lib.TriggerCli, time.Time{})
+	if err != nil && run.ExitCode == 0 {
+		return 1
+	}
+	return int(run.ExitCode)
+}
+
+// detachAfter detaches the jobs running after a job, so that they are not
+// started.
+func detachAfter(config *lib.Config, jobName string) {
+	for _, next := range config.JobsAfter(jobName) {
+		job := config.Jobs[next]
+		job.After = ""
+		config.Jobs[next] = job
+	}
+}
+
+// keepLocal drops the logs dir, the notifications and the sinks, so that a
+// one-off run only prints its output.
+func keepLocal(config *lib.Config) {
+	config.LogsDir = ""
+	config.Notifications = lib.Notifications{}
+	config.Sinks = nil
+	for name, job := range config.Jobs {
+		job.Notifications = lib.Notifications{}
+		job.Sinks = nil
+		config.Jobs[name] = job
+	}
+}
+
+// list prints the configured jobs and their next fire time.
+func list(args []string) int {
+	fs := newCommand("list", "")
+	configFile := configFlag(fs)
+	parseCommand(fs, args, 0)
+
+	config, err := lib.GetConfigFromFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tIMAGE\tSCHEDULE\tNEXT")
+	for _, jobName := range config.JobNames() {
+		job := config.Jobs[jobName]
+		next := "-"
+		if job.Schedule != "" && !job.Suspended {
+			schedule, err := job.GetSchedule()
+			if err == nil {
+				next = schedule.Next(time.Now()).Format(time.RFC3339)
+			}
+		}
+		schedule := job.Schedule
+		if schedule == "" {
+			schedule = "-"
+		}
+		if job.Suspended {
+			schedule += " (suspended)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s:%s\t%s\t%s\n", jobName, job.Type, job.Image, job.Tag, schedule, next)
+	}
+	w.Flush()
+	return 0
+}
+
+// next prints the upcoming fire times of a job.
+func next(args []string) int {
+	fs := newCommand("next", "<job>")
+	configFile := configFlag(fs)
+	n := fs.Int("n", 5, "number of fire times")
+	jobName := parseCommand(fs, args, 1)[0]
+
+	config, err := lib.GetConfigFromFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	job, ok := config.Jobs[jobName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown job %s\n", jobName)
+		return 1
+	}
+	if job.Schedule == "" {
+		fmt.Fprintf(os.Stderr, "job %s is not scheduled\n", jobName)
+		return 1
+	}
+
+	schedule, err := job.GetSchedule()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, t := range schedule.NextN(time.Now(), *n) {
+		fmt.Println(t.Format(time.RFC3339))
+	}
+	return 0
+}
+
+// showConfig prints the effective configuration as yaml, with the defaults
+// and templates applied to the jobs, leaving out the settings not set.
+func showConfig(args []string) int {
+	fs := newCommand("config", "")
+	configFile := configFlag(fs)
+	jobName := fs.String("job", "", "only print the given job")
+	parseCommand(fs, args, 0)
+
+	config, err := lib.GetConfigFromFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	effective := *config
+	effective.Include = nil
+	effective.Defaults = nil
+	effective.Templates = nil
+	var v interface{} = effective
+	if *jobName != "" {
+		job, ok := config.Jobs[*jobName]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown job %s\n", *jobName)
+			return 1
+		}
+		v = job
+	}
+
+	out, err := yaml.Marshal(v)
+	if err == nil {
+		var tree yaml.MapSlice
+		err = yaml.Unmarshal(out, &tree)
+		if err == nil {
+			pruned, _ := pruneEmpty(tree)
+			out, err = yaml.Marshal(pruned)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(string(out))
+	return 0
+}
+
+// pruneEmpty removes the empty values from a yaml tree, returning whether
+// the whole value is empty.
+func pruneEmpty(v interface{}) (interface{}, bool) {
+	switch value := v.(type) {
+	case yaml.MapSlice:
+		pruned := yaml.MapSlice{}
+		for _, item := range value {
+			prunedValue, empty := pruneEmpty(item.Value)
+			if !empty {
+				pruned = append(pruned, yaml.MapItem{Key: item.Key, Value: prunedValue})
+			}
+		}
+		return pruned, len(pruned) == 0
+	case []interface{}:
+		for i, item := range value {
+			value[i], _ = pruneEmpty(item)
+		}
+		return value, len(value) == 0
+	case nil:
+		return nil, true
+	case string:
+		// durations are marshalled as strings
+		return value, value == "" || value == "0s"
+	case bool:
+		return value, !value
+	case int:
+		return value, value == 0
+	}
+	return v, false
+}
+
+// schema prints the JSON Schema of the config, for editors and linters.
+func schema(args []string) int {
+	fs := newCommand("schema", "")
+	parseCommand(fs, args, 0)
+
+	out, err := json.MarshalIndent(lib.JsonSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const clientTimeout = 30 * time.Second
+
+func addrFlag(fs *flag.FlagSet) *string {
+	return fs.String("addr", "http://localhost:8080", "address of the http API of the daemon")
+}
+
+// apiGet GETs a path of the http API, returning an error holding the
+// response body when the status is not 200.
+func apiGet(addr string, path string, timeout time.Duration) (*http.Response, error) {
+	c := &http.Client{Timeout: timeout}
+	res, err := c.Get(strings.TrimRight(addr, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return res, nil
+}
+
+// trigger runs a job, which must be exposed through the API, on a running
+// daemon and prints its output.
+func trigger(args []string) int {
+	fs := newCommand("trigger", "<job>")
+	addr := addrFlag(fs)
+	jobName := parseCommand(fs, args, 1)[0]
+
+	// the response only comes once the job completes
+	res, err := apiGet(*addr, "/jobs/run/"+url.PathEscape(jobName), 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	var response ApiResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, line := range response.Output {
+		fmt.Println(line)
+	}
+	return 0
+}
+
+// logs prints the full logs of a run, kept by a running daemon.
+func logs(args []string) int {
+	fs := newCommand("logs", "<run>")
+	addr := addrFlag(fs)
+	runId := parseCommand(fs, args, 1)[0]
+
+	res, err := apiGet(*addr, "/runs/"+url.PathEscape(runId)+"/logs", clientTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(os.Stdout, res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// history prints the recent runs of a job recorded by a running daemon.
+func history(args []string) int {
+	fs := newCommand("history", "<job>")
+	addr := addrFlag(fs)
+	jobName := parseCommand(fs, args, 1)[0]
+
+	res, err := apiGet(*addr, "/jobs/"+url.PathEscape(jobName)+"/runs", clientTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	var runs []RunResponse
+	err = json.NewDecoder(res.Body).Decode(&runs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tTRIGGER\tSTARTED\tDURATION\tSTATUS\tEXIT CODE")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", run.ID, run.Trigger, run.StartTime.Format(time.RFC3339), run.Duration, run.Status, run.ExitCode)
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/palicao/docker-executor/lib"
+	"github.com/pkg/errors"
+)
+
+// version is the version of the build, set with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+const healthCheckTimeout = 5 * time.Second
+
+type HealthResponse struct {
+	Status   string
+	LastTick time.Time
+}
+
+type ReadyResponse struct {
+	Ready  bool
+	Checks map[string]string
+}
+
+type VersionResponse struct {
+	Version       string
+	ApiVersion    string
+	DockerVersion string `json:",omitempty"`
+	SwarmManager  bool
+	Error         string `json:",omitempty"`
+}
+
+// handleHealth serves GET /healthz, failing when the scheduler stopped
+// checking for due jobs.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	lastTick := s.scheduler.LastTick()
+	res := HealthResponse{Status: "ok", LastTick: lastTick}
+	if time.Since(lastTick) > 3*lib.HeartbeatInterval {
+		res.Status = "scheduler not running"
+		writeJsonStatus(w, http.StatusServiceUnavailable, res)
+		return
+	}
+	writeJson(w, res)
+}
+
+// handleReady serves GET /readyz, failing unless the docker daemon is
+// reachable, a config is loaded and the state file is writable.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	res := ReadyResponse{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		res.Checks[name] = "ok"
+		if err != nil {
+			res.Checks[name] = err.Error()
+			res.Ready = false
+		}
+	}
+
+	check("docker", s.runner.api.Ping(ctx))
+	var configErr error
+	if s.runner.Config() == nil {
+		configErr = errors.New("no config loaded")
+	}
+	check("config", configErr)
+	check("store", s.runner.store.CheckWritable())
+
+	if !res.Ready {
+		writeJsonStatus(w, http.StatusServiceUnavailable, res)
+		return
+	}
+	writeJson(w, res)
+}
+
+// handleVersion serves GET /version.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	res := VersionResponse{Version: version, ApiVersion: s.runner.api.ApiVersion()}
+	var err error
+	res.DockerVersion, res.SwarmManager, err = s.runner.api.Info(ctx)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	writeJson(w, res)
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxOutputBytes is how much of the output of a run is kept in memory
+// when the job does not set max_output_bytes.
+const DefaultMaxOutputBytes = 1024 * 1024
+
+// TailBuffer is a writer keeping only the last bytes written to it, within a
+// fixed size ring.
+type TailBuffer struct {
+	buf     []byte
+	start   int
+	size    int
+	written int64
+}
+
+func NewTailBuffer(maxBytes int) *TailBuffer {
+	return &TailBuffer{buf: make([]byte, maxBytes)}
+}
+
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	t.written += int64(n)
+	capacity := len(t.buf)
+	if capacity == 0 {
+		return n, nil
+	}
+	if len(p) >= capacity {
+		copy(t.buf, p[len(p)-capacity:])
+		t.start, t.size = 0, capacity
+		return n, nil
+	}
+	end := (t.start + t.size) % capacity
+	copied := copy(t.buf[end:], p)
+	copy(t.buf, p[copied:])
+	t.size += len(p)
+	if t.size > capacity {
+		t.start = (t.start + t.size - capacity) % capacity
+		t.size = capacity
+	}
+	return n, nil
+}
+
+// Bytes returns the bytes kept, oldest first.
+func (t *TailBuffer) Bytes() []byte {
+	out := make([]byte, 0, t.size)
+	end := t.start + t.size
+	if end <= len(t.buf) {
+		return append(out, t.buf[t.start:end]...)
+	}
+	out = append(out, t.buf[t.start:]...)
+	return append(out, t.buf[:end-len(t.buf)]...)
+}
+
+// Truncated returns whether older bytes were dropped.
+func (t *TailBuffer) Truncated() bool {
+	return t.written > int64(t.size)
+}
+
+// tailLines returns the last lines of b, and whether any were dropped.
+func tailLines(b []byte, lines int) ([]byte, bool) {
+	if lines <= 0 {
+		return b, false
+	}
+	trimmed := bytes.TrimRight(b, "\n")
+	i := len(trimmed)
+	for n := 0; n < lines; n++ {
+		i = bytes.LastIndexByte(trimmed[:i], '\n')
+		if i < 0 {
+			return b, false
+		}
+	}
+	return b[i+1:], true
+}
+
+// Capture demultiplexes the log stream of a run into bounded buffers of the
+// combined output and of stdout alone, optionally spilling the whole combined
+// output to a writer.
+type Capture struct {
+	combined  *TailBuffer
+	stdout    *TailBuffer
+	tailLines int
+	spill     io.Writer
+}
+
+// NewCapture creates a capture for a job, spilling to the given writer if not
+// nil.
+func NewCapture(job Job, spill io.Writer) *Capture {
+	maxBytes := job.MaxOutputBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxOutputBytes
+	}
+	if spill == nil {
+		spill = ioutil.Discard
+	}
+	return &Capture{
+		combined:  NewTailBuffer(maxBytes),
+		stdout:    NewTailBuffer(maxBytes),
+		tailLines: job.OutputTailLines,
+		spill:     spill,
+	}
+}
+
+func (c *Capture) read(logs io.Reader) error {
+	_, err := stdcopy.StdCopy(io.MultiWriter(c.combined, c.stdout, c.spill), io.MultiWriter(c.combined, c.spill), logs)
+	return err
+}
+
+// Logs returns the tail of the combined output, and whether it was truncated.
+func (c *Capture) Logs() ([]byte, bool) {
+	logs, dropped := tailLines(c.combined.Bytes(), c.tailLines)
+	return logs, dropped || c.combined.Truncated()
+}
+
+// Stdout returns the tail of stdout, from which outputs are extracted.
+func (c *Capture) Stdout() []byte {
+	return c.stdout.Bytes()
+}
+
+// LogDir keeps the full output of the runs, in a file per run.
+type LogDir struct {
+	dir string
+}
+
+func NewLogDir(dir string) *LogDir {
+	return &LogDir{dir: dir}
+}
+
+func (l *LogDir) path(runId string) (string, error) {
+	_, err := hex.DecodeString(runId)
+	if err != nil || runId == "" {
+		return "", errors.Errorf("invalid run id %s", runId)
+	}
+	return filepath.Join(l.dir, runId+".log"), nil
+}
+
+// Create creates the log file of a run.
+func (l *LogDir) Create(runId string) (*os.File, error) {
+	err := os.MkdirAll(l.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	path, err := l.path(runId)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// Open opens the log file of a run.
+func (l *LogDir) Open(runId string) (*os.File, error) {
+	path, err := l.path(runId)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Remove deletes the log file of a run, if any.
+func (l *LogDir) Remove(runId string) error {
+	path, err := l.path(runId)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CatchupNone = "none"
+	CatchupLast = "last"
+	CatchupAll  = "all"
+
+	maxCatchupRuns = 100
+)
+
+func validateCatchup(job Job) error {
+	switch job.Catchup {
+	case CatchupNone:
+	case CatchupLast, CatchupAll:
+		if job.Schedule == "" {
+			return errors.New("catchup is only allowed for scheduled jobs")
+		}
+	default:
+		return errors.New("catchup can only be none, last or all")
+	}
+	return nil
+}
+
+// MissedRuns returns the fire times missed between lastFire and now which
+// must be caught up according to the job catchup policy. Fire times older
+// than the starting deadline, if any, are dropped, and at most the last
+// hundred are returned.
+func MissedRuns(job Job, schedule *Schedule, lastFire time.Time, now time.Time) []time.Time {
+	if job.Catchup == CatchupNone || job.Catchup == "" {
+		return nil
+	}
+	limit := maxCatchupRuns
+	if job.Catchup == CatchupLast {
+		limit = 1
+	}
+
+	from := lastFire
+	if job.StartingDeadline > 0 {
+		deadline := now.Add(-job.StartingDeadline - time.Nanosecond)
+		if deadline.After(from) {
+			from = deadline
+		}
+	}
+
+	// the fire times are looked for back from now, in a window doubling until
+	// it holds enough of them, so that a long downtime does not go through
+	// every fire time of a frequent job
+	span := now.Sub(from)
+	for window := time.Minute; ; window *= 2 {
+		start := now.Add(-window)
+		if window > span/2 {
+			start = from
+		}
+		missed := []time.Time{}
+		for t := schedule.Next(start); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+			missed = append(missed, t)
+		}
+		if len(missed) >= limit || start.Equal(from) {
+			if len(missed) > limit {
+				missed = missed[len(missed)-limit:]
+			}
+			return missed
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMissedRuns(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 30, 0, time.UTC)
+	tests := []struct {
+		name     string
+		spec     string
+		catchup  string
+		deadline time.Duration
+		lastFire time.Time
+		want     []time.Time
+	}{
+		{
+			name:     "none",
+			spec:     "0 * * * *",
+			catchup:  CatchupNone,
+			lastFire: now.Add(-3 * time.Hour),
+		},
+		{
+			name:     "all",
+			spec:     "0 * * * *",
+			catchup:  CatchupAll,
+			lastFire: time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+				time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC),
+				time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:     "last",
+			spec:     "0 * * * *",
+			catchup:  CatchupLast,
+			lastFire: time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC),
+			want:     []time.Time{time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:     "nothing missed",
+			spec:     "0 * * * *",
+			catchup:  CatchupAll,
+			lastFire: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+			want:     []time.Time{},
+		},
+		{
+			name:     "starting deadline",
+			spec:     "0 * * * *",
+			catchup:  CatchupAll,
+			deadline: 90 * time.Minute,
+			lastFire: time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC),
+				time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:     "starting deadline passed",
+			spec:     "0 0 * * *",
+			catchup:  CatchupLast,
+			deadline: time.Hour,
+			lastFire: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			want:     []time.Time{},
+		},
+		{
+			name:     "rare",
+			spec:     "0 0 1 1 *",
+			catchup:  CatchupLast,
+			lastFire: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:     []time.Time{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.spec, "UTC", test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := Job{Catchup: test.catchup, StartingDeadline: test.deadline}
+		got := MissedRuns(job, schedule, test.lastFire, now)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: missed %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(test.want[i]) {
+				t.Errorf("%s: missed %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMissedRunsLongDowntime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 30, 0, time.UTC)
+	schedule, err := ParseSchedule("* * * * *", "UTC", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	missed := MissedRuns(Job{Catchup: CatchupAll}, schedule, now.AddDate(-1, 0, 0), now)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("catching up a year of a job firing every minute took %v", elapsed)
+	}
+	if len(missed) != maxCatchupRuns {
+		t.Fatalf("missed %d runs, want %d", len(missed), maxCatchupRuns)
+	}
+	first, last := time.Date(2024, 6, 1, 10, 21, 0, 0, time.UTC), time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if !missed[0].Equal(first) || !missed[len(missed)-1].Equal(last) {
+		t.Errorf("missed %v to %v, want %v to %v", missed[0], missed[len(missed)-1], first, last)
+	}
+
+	missed = MissedRuns(Job{Catchup: CatchupLast}, schedule, now.AddDate(-1, 0, 0), now)
+	if len(missed) != 1 || !missed[0].Equal(last) {
+		t.Errorf("missed %v, want %v", missed, last)
+	}
+
+	hourly, _ := ParseSchedule("0 * * * *", "UTC", "job")
+	missed = MissedRuns(Job{Catchup: CatchupAll}, hourly, now.AddDate(-10, 0, 0), now)
+	if len(missed) != maxCatchupRuns || !missed[0].Equal(last.Add(-99*time.Hour)) {
+		t.Errorf("missed %d runs from %v", len(missed), missed)
+	}
+}
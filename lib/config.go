@@ -3,7 +3,14 @@ package lib
 import (
 	"fmt"
 	"io/ioutil"
-	"github.com/gorhill/cronexpr"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
@@ -11,73 +18,663 @@ import (
 const (
 	JobTypeRun     = "run"
 	JobTypeService = "service"
+	ModeReplicated = "replicated"
+	ModeGlobal     = "global"
 	ImageTagLatest = "latest"
 )
 
 type Job struct {
-	Type                 string   `yaml:"type"`
-	Image                string   `yaml:"image"`
-	Tag                  string   `yaml:"tag"`
-	Service              string   `yaml:"service"`
-	Schedule             string   `yaml:"schedule"`
-	Secrets              []string `yaml:"secrets"`
-	Configs              []string `yaml:"configs"`
-	Cmd                  []string `yaml:"cmd"`
-	Env                  []string `yaml:"env"`
-	Constraints          []string `yaml:"constraints"`
-	PlacementPreferences []string `yaml:"placement_preferences"`
-	ApiExpose            bool     `yaml:"api_expose"`
+	Name                 string        `yaml:"-"`
+	Type                 string        `yaml:"type"`
+	Image                string        `yaml:"image"`
+	Tag                  string        `yaml:"tag"`
+	Service              string        `yaml:"service"`
+	Schedule             string        `yaml:"schedule"`
+	Timezone             string        `yaml:"timezone"`
+	Catchup              string        `yaml:"catchup"`
+	StartingDeadline     time.Duration `yaml:"starting_deadline"`
+	Jitter               time.Duration `yaml:"jitter"`
+	Timeout              time.Duration `yaml:"timeout"`
+	MaxOutputBytes       int           `yaml:"max_output_bytes"`
+	OutputTailLines      int           `yaml:"output_tail_lines"`
+	Secrets              []string      `yaml:"secrets"`
+	Configs              []string      `yaml:"configs"`
+	Cmd                  []string      `yaml:"cmd"`
+	Env                  EnvList       `yaml:"env"`
+	EnvFile              []string      `yaml:"env_file"`
+	Constraints          []string      `yaml:"constraints"`
+	PlacementPreferences []string      `yaml:"placement_preferences"`
+	Mode                 string        `yaml:"mode"`
+	Replicas             int           `yaml:"replicas"`
+	MinSuccessful        int           `yaml:"min_successful"`
+	ApiExpose            bool          `yaml:"api_expose"`
+	Suspended            bool          `yaml:"suspended"`
+	Output               *JobOutput    `yaml:"output"`
+	After                string        `yaml:"after"`
+	Extends              string        `yaml:"extends"`
+	Notifications        Notifications `yaml:"notifications"`
+	Sinks                []SinkConfig  `yaml:"sinks"`
+	Source               string        `yaml:"-"`
+	// set are the keys of the job found in its file, and in the templates
+	// and defaults it was merged with.
+	set map[string]bool
 }
 
 type Config struct {
-	Jobs map[string]Job `yaml:"jobs"`
+	Timezone      string         `yaml:"timezone"`
+	StateFile     string         `yaml:"state_file"`
+	JobOutput     string         `yaml:"job_output"`
+	LogsDir       string         `yaml:"logs_dir"`
+	Notifications Notifications  `yaml:"notifications"`
+	Smtp          *Smtp          `yaml:"smtp"`
+	Sinks         []SinkConfig   `yaml:"sinks"`
+	Include       []string       `yaml:"include"`
+	Defaults      *Job           `yaml:"defaults"`
+	Templates     map[string]Job `yaml:"templates"`
+	Jobs          map[string]Job `yaml:"jobs"`
+	Files         []string       `yaml:"-"`
 }
 
-func validateJob(job Job) error {
-	if job.Type != JobTypeRun && job.Type != JobTypeService {
-		return errors.New("type can only be run or service")
+// JobNames returns the names of the configured jobs, sorted.
+func (config *Config) JobNames() []string {
+	names := []string{}
+	for name := range config.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JobsAfter returns the names of the jobs that run once the given job
+// completes.
+func (config *Config) JobsAfter(name string) []string {
+	names := []string{}
+	for i, j := range config.Jobs {
+		if j.After == name {
+			names = append(names, i)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldError is an error about a field of a job, named by its key.
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e fieldError) Error() string {
+	return e.err.Error()
+}
+
+// validateJob returns all the errors of a job.
+func validateJob(job Job) []error {
+	var errs []error
+	invalid := func(field string, err error) {
+		errs = append(errs, fieldError{field: field, err: err})
+	}
+
+	err := validateType(job.Type)
+	if err != nil {
+		invalid("type", err)
 	}
 
 	if job.Image == "" {
-		return errors.New("image must not be empty")
+		invalid("image", errors.New("image must not be empty"))
 	}
 
-	if job.Schedule != "" {
-		_, err := cronexpr.Parse(job.Schedule)
+	timezoneValid := true
+	if job.Timezone != "" {
+		_, err := loadLocation(job.Timezone)
 		if err != nil {
-			return errors.New("schedule must be a valid cron expression")
+			invalid("timezone", err)
+			timezoneValid = false
+		}
+	}
+
+	if job.Schedule != "" && timezoneValid {
+		_, err := job.GetSchedule()
+		if err != nil {
+			invalid("schedule", errors.Wrap(err, "schedule must be a valid cron expression"))
+		}
+	}
+
+	if job.Type == JobTypeRun {
+		serviceOnly := []struct {
+			field string
+			value []string
+		}{
+			{"secrets", job.Secrets},
+			{"configs", job.Configs},
+			{"constraints", job.Constraints},
+			{"placement_preferences", job.PlacementPreferences},
+		}
+		for _, option := range serviceOnly {
+			if len(option.value) > 0 {
+				invalid(option.field, errors.New("secrets, configs, constraint and placement preferences are only allowed for services"))
+				break
+			}
 		}
 	}
 
-	if job.Type == JobTypeRun && (len(job.Secrets) > 0 || len(job.Configs) > 0 || len(job.Constraints) > 0 || len(job.PlacementPreferences) > 0) {
-		return errors.New("secrets, configs, constraint and placement preferences are only allowed for services")
+	if job.Jitter < 0 {
+		invalid("jitter", errors.New("jitter must not be negative"))
 	}
 
+	if job.Timeout < 0 {
+		invalid("timeout", errors.New("timeout must not be negative"))
+	}
+
+	if job.MaxOutputBytes < 0 {
+		invalid("max_output_bytes", errors.New("max_output_bytes must not be negative"))
+	}
+
+	if job.OutputTailLines < 0 {
+		invalid("output_tail_lines", errors.New("output_tail_lines must not be negative"))
+	}
+
+	err = validateCatchup(job)
+	if err != nil {
+		invalid("catchup", err)
+	}
+
+	if job.StartingDeadline < 0 {
+		invalid("starting_deadline", errors.New("starting_deadline must not be negative"))
+	}
+
+	if job.Type == JobTypeService {
+		field, err := validateMode(job)
+		if err != nil {
+			invalid(field, err)
+		}
+		for _, expression := range job.Constraints {
+			_, err := parseConstraint(expression)
+			if err != nil {
+				invalid("constraints", err)
+				break
+			}
+		}
+	} else {
+		for _, option := range []struct {
+			field string
+			set   bool
+		}{
+			{"mode", job.Mode != ""},
+			{"replicas", job.Replicas != 0},
+			{"min_successful", job.MinSuccessful != 0},
+		} {
+			if option.set {
+				invalid(option.field, errors.New("mode, replicas and min_successful are only allowed for services"))
+				break
+			}
+		}
+	}
+
+	if job.Output != nil {
+		err := validateOutput(job.Output, job.Type)
+		if err != nil {
+			invalid("output", err)
+		} else if job.Mode == ModeGlobal || job.Replicas > 1 {
+			invalid("output", errors.New("output is only allowed for jobs running a single task"))
+		}
+	}
+
+	err = validateNotifications(job.Notifications)
+	if err != nil {
+		invalid("notifications", err)
+	}
+
+	err = validateSinks(job.Sinks)
+	if err != nil {
+		invalid("sinks", err)
+	}
+
+	err = validateTemplates(job)
+	if err != nil {
+		invalid("", err)
+	}
+
+	return errs
+}
+
+func validateAfter(jobs map[string]Job, name string) error {
+	seen := map[string]bool{name: true}
+	for current := jobs[name]; current.After != ""; current = jobs[current.After] {
+		if _, ok := jobs[current.After]; !ok {
+			return errors.Errorf("after refers to unknown job %s", current.After)
+		}
+		if seen[current.After] {
+			return errors.New("after must not form a cycle")
+		}
+		seen[current.After] = true
+	}
 	return nil
 }
 
-func prepareJob(job Job) Job {
+// validateMode returns the field and the error of a service with an invalid
+// mode, replica count or success policy.
+func validateMode(job Job) (string, error) {
+	switch job.Mode {
+	case ModeReplicated:
+		if job.Replicas < 1 {
+			return "replicas", errors.New("replicas must be at least 1")
+		}
+		if job.MinSuccessful > job.Replicas {
+			return "min_successful", errors.New("min_successful must not exceed replicas")
+		}
+	case ModeGlobal:
+		if job.Replicas != 0 {
+			return "replicas", errors.New("replicas is only allowed in replicated mode")
+		}
+	default:
+		return "mode", errors.New("mode can only be replicated or global")
+	}
+	if job.MinSuccessful < 0 {
+		return "min_successful", errors.New("min_successful must not be negative")
+	}
+	return "", nil
+}
+
+// prepareJob applies to a job its templates and the defaults, then the
+// default settings.
+func prepareJob(job Job, config *Config) (Job, error) {
+	job, err := extendJob(job, config)
 	if job.Tag == "" {
 		job.Tag = ImageTagLatest
 	}
-	return job
+	if job.Timezone == "" {
+		job.Timezone = config.Timezone
+	}
+	if job.Catchup == "" {
+		job.Catchup = CatchupNone
+	}
+	if job.Type == JobTypeService && job.Mode == "" {
+		job.Mode = ModeReplicated
+	}
+	if job.Mode == ModeReplicated && job.Replicas == 0 {
+		job.Replicas = 1
+	}
+	return job, err
 }
 
-func GetConfigFromFile(filename string) (config *Config, err error) {
-	configFile, err := ioutil.ReadFile(filename)
+// GetSchedule parses the job schedule in the job timezone, hashing H fields
+// by job name.
+func (job Job) GetSchedule() (*Schedule, error) {
+	schedule, err := ParseSchedule(job.Schedule, job.Timezone, job.Name)
 	if err != nil {
-		return config, fmt.Errorf("unable to read file %s: %v", filename, err)
+		return nil, err
+	}
+	return schedule.WithJitter(job.Jitter), nil
+}
+
+// ConfigError is an error found validating a configuration, located at the
+// key it is about when possible.
+type ConfigError struct {
+	File    string
+	Line    int    `json:",omitempty"`
+	Column  int    `json:",omitempty"`
+	Job     string `json:",omitempty"`
+	Field   string `json:",omitempty"`
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	where := e.File
+	if e.Line > 0 {
+		where += ":" + strconv.Itoa(e.Line)
+	}
+	if e.Column > 0 {
+		where += ":" + strconv.Itoa(e.Column)
+	}
+	if e.Job != "" {
+		return fmt.Sprintf("%s: configuration for job %s not valid: %s", where, e.Job, e.Message)
+	}
+	return fmt.Sprintf("%s: configuration not valid: %s", where, e.Message)
+}
+
+// ConfigErrors lists all the errors found validating a configuration, in the
+// order of the file.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
 	}
-	err = yaml.Unmarshal(configFile, &config)
+	return strings.Join(messages, "\n")
+}
+
+func (errs ConfigErrors) Len() int {
+	return len(errs)
+}
+
+func (errs ConfigErrors) Less(i, j int) bool {
+	if errs[i].File != errs[j].File {
+		return errs[i].File < errs[j].File
+	}
+	if errs[i].Line != errs[j].Line {
+		return errs[i].Line < errs[j].Line
+	}
+	return errs[i].Column < errs[j].Column
+}
+
+func (errs ConfigErrors) Swap(i, j int) {
+	errs[i], errs[j] = errs[j], errs[i]
+}
+
+var yamlLineRegexp = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors turns the errors of the yaml decoder into located ones.
+func yamlErrors(filename string, err error) ConfigErrors {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	var errs ConfigErrors
+	for _, message := range messages {
+		configErr := ConfigError{File: filename, Message: message}
+		match := yamlLineRegexp.FindStringSubmatch(message)
+		if match != nil {
+			configErr.Line, _ = strconv.Atoi(match[1])
+			configErr.Message = match[2]
+		}
+		errs = append(errs, configErr)
+	}
+	return errs
+}
+
+// ConfigFiles returns the files a config path refers to: all the yaml files
+// of a directory, the files matching a glob, or a single file.
+func ConfigFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		var files []string
+		for _, extension := range configExtensions {
+			matches, _ := filepath.Glob(filepath.Join(path, "*"+extension))
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no config files in directory %s", path)
+		}
+		return files, nil
+	}
+	if err == nil {
+		return []string{path}, nil
+	}
+
+	files, globErr := filepath.Glob(path)
+	if globErr != nil || len(files) == 0 {
+		return nil, fmt.Errorf("unable to read file %s: %v", path, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// configFile is a file of a configuration, with the position of its keys.
+type configFile struct {
+	name   string
+	config *Config
+	keys   []keyPosition
+}
+
+// readConfigFile reads a single file, interpolating variables and checking
+// its keys. Type errors leave the rest of the file decoded, so that the other
+// errors can be found as well.
+func readConfigFile(filename string) (*configFile, ConfigErrors, error) {
+	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return config, fmt.Errorf("unable to unmarshall file %s: %v", filename, err)
+		return nil, nil, fmt.Errorf("unable to read file %s: %v", filename, err)
 	}
-	for i, j := range config.Jobs {
-		err = validateJob(j)
+	content, errs := interpolate(filename, content, os.LookupEnv)
+	config, keys, decodeErrs, err := decodeConfig(filename, content)
+	if syntaxErrs, ok := err.(ConfigErrors); ok && len(errs) > 0 {
+		return nil, nil, append(errs, syntaxErrs...)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	errs = append(errs, decodeErrs...)
+
+	file := &configFile{name: filename, config: config, keys: keys}
+	for _, k := range duplicateKeys(file.keys) {
+		message := "duplicate key " + k.path[len(k.path)-1]
+		if len(k.path) == 2 && k.path[0] == "jobs" {
+			message = "duplicate job name " + k.path[1]
+		}
+		errs = append(errs, file.keyError(k, message))
+	}
+	for _, k := range unknownKeys(file.keys, reflect.TypeOf(Config{})) {
+		errs = append(errs, file.keyError(k, "unknown key "+k.path[len(k.path)-1]))
+	}
+	return file, errs, nil
+}
+
+// errorAt returns an error located at the deepest key of a path found in the
+// file.
+func (file *configFile) errorAt(path []string, message string) ConfigError {
+	configErr := ConfigError{File: file.name, Message: message}
+	if position := locate(file.keys, path); position != nil {
+		configErr.Line, configErr.Column = position.line, position.column
+	}
+	return configErr
+}
+
+func (file *configFile) keyError(k keyPosition, message string) ConfigError {
+	configErr := ConfigError{File: file.name, Line: k.line, Column: k.column, Message: message}
+	if len(k.path) > 2 && k.path[0] == "jobs" {
+		configErr.Job = k.path[1]
+	}
+	return configErr
+}
+
+// setKeys returns the keys found in the file within the mapping at a path.
+func (file *configFile) setKeys(path ...string) map[string]bool {
+	keys := map[string]bool{}
+	for _, k := range file.keys {
+		if len(k.path) == len(path)+1 && nestedUnder(k.path, path) {
+			keys[k.path[len(path)]] = true
+		}
+	}
+	return keys
+}
+
+// merge adds the jobs and settings of a file to a configuration. A job or a
+// setting defined by two files is an error.
+func merge(config *Config, file *configFile) ConfigErrors {
+	var errs ConfigErrors
+	conflict := func(path []string, message string) {
+		errs = append(errs, file.errorAt(path, message))
+	}
+
+	settings := []struct {
+		key   string
+		into  *string
+		value string
+	}{
+		{"timezone", &config.Timezone, file.config.Timezone},
+		{"state_file", &config.StateFile, file.config.StateFile},
+		{"job_output", &config.JobOutput, file.config.JobOutput},
+		{"logs_dir", &config.LogsDir, file.config.LogsDir},
+	}
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		if *setting.into != "" && *setting.into != setting.value {
+			conflict([]string{setting.key}, setting.key+" is already set by another file")
+			continue
+		}
+		*setting.into = setting.value
+	}
+	if file.config.Smtp != nil {
+		if config.Smtp != nil {
+			conflict([]string{"smtp"}, "smtp is already set by another file")
+		} else {
+			config.Smtp = file.config.Smtp
+		}
+	}
+	config.Notifications.Webhooks = append(config.Notifications.Webhooks, file.config.Notifications.Webhooks...)
+	config.Notifications.Emails = append(config.Notifications.Emails, file.config.Notifications.Emails...)
+	config.Sinks = append(config.Sinks, file.config.Sinks...)
+
+	if file.config.Defaults != nil {
+		if config.Defaults != nil {
+			conflict([]string{"defaults"}, "defaults are already set by another file")
+		} else {
+			defaults := absEnvFiles(*file.config.Defaults, file.name)
+			defaults.set = file.setKeys("defaults")
+			config.Defaults = &defaults
+		}
+	}
+	if config.Templates == nil {
+		config.Templates = make(map[string]Job)
+	}
+	for name, template := range file.config.Templates {
+		if _, ok := config.Templates[name]; ok {
+			conflict([]string{"templates", name}, fmt.Sprintf("template %s is already defined by another file", name))
+			continue
+		}
+		template = absEnvFiles(template, file.name)
+		template.set = file.setKeys("templates", name)
+		config.Templates[name] = template
+	}
+
+	if config.Jobs == nil {
+		config.Jobs = make(map[string]Job)
+	}
+	for name, job := range file.config.Jobs {
+		if other, ok := config.Jobs[name]; ok {
+			conflict([]string{"jobs", name}, fmt.Sprintf("job %s is already defined in %s", name, other.Source))
+			continue
+		}
+		job.Source = file.name
+		job.set = file.setKeys("jobs", name)
+		config.Jobs[name] = job
+	}
+	return errs
+}
+
+// GetConfigFromFile reads and validates a configuration from a file, the
+// yaml files of a directory or the files matching a glob, along with the
+// files they include. When it is not valid the error is a ConfigErrors,
+// holding every error found: unset variables, unknown and duplicate keys as
+// well as the invalid values of every job, located in the file defining them.
+// Variables are interpolated before parsing; includes and env files are
+// relative to the file referring to them.
+func GetConfigFromFile(path string) (config *Config, err error) {
+	queue, err := ConfigFiles(path)
+	if err != nil {
+		return config, err
+	}
+
+	config = &Config{}
+	var errs ConfigErrors
+	files := map[string]*configFile{}
+	for len(queue) > 0 {
+		filename := filepath.Clean(queue[0])
+		queue = queue[1:]
+		if _, ok := files[filename]; ok {
+			continue
+		}
+		file, fileErrs, err := readConfigFile(filename)
+		if err != nil {
+			return config, err
+		}
+		files[filename] = file
+		config.Files = append(config.Files, filename)
+		errs = append(errs, fileErrs...)
+		errs = append(errs, merge(config, file)...)
+
+		for _, include := range file.config.Include {
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(filename), include)
+			}
+			included, err := ConfigFiles(include)
+			if err != nil {
+				errs = append(errs, file.errorAt([]string{"include"}, err.Error()))
+				continue
+			}
+			queue = append(queue, included...)
+		}
+	}
+
+	// global settings are located in the first file setting them
+	invalid := func(path []string, field string, err error) {
+		configErr := ConfigError{File: config.Files[0], Field: field, Message: err.Error()}
+		for _, filename := range config.Files {
+			if position := locate(files[filename].keys, path[:1]); position != nil {
+				position = locate(files[filename].keys, path)
+				configErr.File, configErr.Line, configErr.Column = filename, position.line, position.column
+				break
+			}
+		}
+		errs = append(errs, configErr)
+	}
+	invalidJob := func(jobName string, err error) {
+		job := config.Jobs[jobName]
+		path := []string{"jobs", jobName}
+		configErr := ConfigError{File: job.Source, Job: jobName, Message: err.Error()}
+		if fieldErr, ok := err.(fieldError); ok && fieldErr.field != "" {
+			configErr.Field = fieldErr.field
+			path = append(path, fieldErr.field)
+		}
+		if position := locate(files[job.Source].keys, path); position != nil {
+			configErr.Line, configErr.Column = position.line, position.column
+		}
+		errs = append(errs, configErr)
+	}
+
+	_, err = loadLocation(config.Timezone)
+	if err != nil {
+		invalid([]string{"timezone"}, "timezone", err)
+		// not to report the same error for every job inheriting it
+		config.Timezone = ""
+	}
+	err = validateNotifications(config.Notifications)
+	if err != nil {
+		invalid([]string{"notifications"}, "notifications", err)
+	}
+	err = validateSinks(config.Sinks)
+	if err != nil {
+		invalid([]string{"sinks"}, "sinks", err)
+	}
+	if config.Smtp != nil {
+		err = validateSmtp(config.Smtp)
 		if err != nil {
-			return config, fmt.Errorf("configuration for job %s not valid: %v", i, err)
+			invalid([]string{"smtp"}, "smtp", err)
 		}
-		config.Jobs[i] = prepareJob(j)
+	} else if len(config.Notifications.Emails) > 0 {
+		invalid([]string{"notifications", "emails"}, "notifications", errors.New("email notifications require smtp"))
+	}
+	for _, i := range config.JobNames() {
+		j := config.Jobs[i]
+		j.Name = i
+		j, err = prepareJob(j, config)
+		if err != nil {
+			invalidJob(i, err)
+		}
+		j.Env, err = loadEnvFiles(j, filepath.Dir(j.Source))
+		if err != nil {
+			invalidJob(i, fieldError{field: "env_file", err: err})
+		}
+		for _, err := range validateJob(j) {
+			invalidJob(i, err)
+		}
+		config.Jobs[i] = j
+	}
+	for _, i := range config.JobNames() {
+		err = validateAfter(config.Jobs, i)
+		if err != nil {
+			invalidJob(i, fieldError{field: "after", err: err})
+		}
+		if len(config.Jobs[i].Notifications.Emails) > 0 && config.Smtp == nil {
+			invalidJob(i, fieldError{field: "notifications", err: errors.New("email notifications require smtp")})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Stable(errs)
+		return config, errs
 	}
 	return config, nil
 }
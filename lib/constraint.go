@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/pkg/errors"
+)
+
+// constraint is a placement constraint of a service, key==value or
+// key!=value, as swarm evaluates them.
+type constraint struct {
+	key   string
+	equal bool
+	value string
+}
+
+func parseConstraint(expression string) (constraint, error) {
+	for _, operator := range []string{"==", "!="} {
+		parts := strings.SplitN(expression, operator, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		c := constraint{
+			key:   strings.TrimSpace(parts[0]),
+			equal: operator == "==",
+			value: strings.TrimSpace(parts[1]),
+		}
+		if c.key == "" || c.value == "" {
+			break
+		}
+		if !c.known() {
+			return constraint{}, errors.Errorf("unknown constraint key %s", c.key)
+		}
+		return c, nil
+	}
+	return constraint{}, errors.Errorf("constraint %s must be key==value or key!=value", expression)
+}
+
+// known tells whether the key is one swarm evaluates.
+func (c constraint) known() bool {
+	key := strings.ToLower(c.key)
+	switch key {
+	case "node.id", "node.hostname", "node.role", "node.platform.os", "node.platform.arch":
+		return true
+	}
+	return strings.HasPrefix(key, "node.labels.") || strings.HasPrefix(key, "engine.labels.")
+}
+
+// matches tells whether a node satisfies the constraint. Values are compared
+// ignoring case, a missing label being different from any value.
+func (c constraint) matches(node swarm.Node) bool {
+	var value string
+	var ok bool
+	key := strings.ToLower(c.key)
+	switch {
+	case key == "node.id":
+		value, ok = node.ID, true
+	case key == "node.hostname":
+		value, ok = node.Description.Hostname, true
+	case key == "node.role":
+		value, ok = string(node.Spec.Role), true
+	case key == "node.platform.os":
+		value, ok = node.Description.Platform.OS, true
+	case key == "node.platform.arch":
+		value, ok = node.Description.Platform.Architecture, true
+	case strings.HasPrefix(key, "node.labels."):
+		value, ok = node.Spec.Labels[c.key[len("node.labels."):]]
+	case strings.HasPrefix(key, "engine.labels."):
+		value, ok = node.Description.Engine.Labels[c.key[len("engine.labels."):]]
+	}
+	return ok && strings.EqualFold(value, c.value) == c.equal || !ok && !c.equal
+}
+
+// nodeMatches tells whether a node satisfies all the constraints.
+func nodeMatches(node swarm.Node, constraints []string) (bool, error) {
+	for _, expression := range constraints {
+		c, err := parseConstraint(expression)
+		if err != nil {
+			return false, err
+		}
+		if !c.matches(node) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
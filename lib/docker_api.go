@@ -2,24 +2,103 @@ package lib
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"sort"
 	"time"
+	"github.com/sirupsen/logrus"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/pkg/errors"
 )
 
+const (
+	// jobModesApiVersion is the first API version with the service modes
+	// running tasks to completion.
+	jobModesApiVersion = "1.41"
+
+	// serviceIdLabel is the label of the containers of a service task.
+	serviceIdLabel = "com.docker.swarm.service.id"
+
+	taskCheckInterval = 5 * time.Second
+	taskPollInterval  = 500 * time.Millisecond
+)
+
 type DockerApi struct {
-	client *client.Client
+	client DockerClient
 }
 
-func NewDockerApi(cli *client.Client) *DockerApi {
+func NewDockerApi(cli DockerClient) *DockerApi {
 	return &DockerApi{client: cli}
 }
 
+// Ping checks that the daemon is reachable.
+func (api *DockerApi) Ping(ctx context.Context) error {
+	_, err := api.client.Ping(ctx)
+	return err
+}
+
+// ApiVersion returns the API version negotiated with the daemon.
+func (api *DockerApi) ApiVersion() string {
+	return api.client.ClientVersion()
+}
+
+// Info returns the version of the daemon, and whether it is a swarm manager,
+// which running services requires.
+func (api *DockerApi) Info(ctx context.Context) (version string, swarmManager bool, err error) {
+	info, err := api.client.Info(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	return info.ServerVersion, info.Swarm.ControlAvailable, nil
+}
+
+// jobModes returns whether the daemon supports the replicated and global job
+// service modes.
+func (api *DockerApi) jobModes() bool {
+	return !versions.LessThan(api.client.ClientVersion(), jobModesApiVersion)
+}
+
+// nodeHostname returns the hostname of a swarm node, or its id if it can't
+// be inspected.
+func (api *DockerApi) nodeHostname(ctx context.Context, nodeId string) string {
+	node, _, err := api.client.NodeInspectWithRaw(ctx, nodeId)
+	if err != nil || node.Description.Hostname == "" {
+		LoggerFrom(ctx).WithField("node", nodeId).WithError(err).Debug("unable to inspect node")
+		return nodeId
+	}
+	return node.Description.Hostname
+}
+
+// eligibleNodes returns the number of nodes a global service runs a task on:
+// the ready and active nodes satisfying its constraints.
+func (api *DockerApi) eligibleNodes(ctx context.Context, constraints []string) (int, error) {
+	nodes, err := api.client.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to list nodes")
+	}
+	eligible := 0
+	for _, node := range nodes {
+		if node.Status.State != swarm.NodeStateReady || node.Spec.Availability != swarm.NodeAvailabilityActive {
+			continue
+		}
+		ok, err := nodeMatches(node, constraints)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			eligible++
+		}
+	}
+	return eligible, nil
+}
+
 func (api *DockerApi) imageExists(ctx context.Context, image string, tag string) (result bool, err error) {
 	filterArgs := filters.NewArgs()
 	filterArgs.Add("reference", image+":"+tag)
@@ -45,109 +124,238 @@ func (api *DockerApi) pullImage(ctx context.Context, image string, tag string) e
 	return nil
 }
 
-func (api *DockerApi) isTaskComplete(ctx context.Context, serviceId string, doneC chan bool, errC chan error) {
-	filterArgs := filters.NewArgs()
-	filterArgs.Add("service", serviceId)
-	tasks, err := api.client.TaskList(ctx, types.TaskListOptions{Filters: filterArgs})
-	if err != nil {
-		errC <- err
+// terminalStates are the states a task never leaves.
+var terminalStates = map[swarm.TaskState]bool{
+	swarm.TaskStateComplete: true,
+	swarm.TaskStateShutdown: true,
+	swarm.TaskStateFailed:   true,
+	swarm.TaskStateRejected: true,
+}
+
+// tasksDone returns whether at least a number of tasks were created and all
+// of them reached a terminal state.
+func tasksDone(tasks []swarm.Task, expected int) bool {
+	if len(tasks) == 0 || len(tasks) < expected {
+		return false
+	}
+	for _, task := range tasks {
+		if !terminalStates[task.Status.State] {
+			return false
+		}
 	}
+	return true
+}
 
-	if len(tasks) != 1 {
-		errC <- errors.Errorf("unable to inspect tasks for service %s", serviceId)
+// tasksWait waits for the tasks of a service to reach a terminal state, at
+// least the expected number of them, returning them. Every listing of the
+// tasks is observed, the last one being returned along with errors. The tasks
+// are checked whenever a container of the service exits on this node. They
+// are polled often while some are yet to be created or run on other nodes,
+// whose containers exiting can't be seen, or when events are not available.
+func (api *DockerApi) tasksWait(ctx context.Context, serviceId string, expected int, observe func([]swarm.Task)) ([]swarm.Task, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	eventArgs := filters.NewArgs()
+	eventArgs.Add("type", events.ContainerEventType)
+	eventArgs.Add("event", "die")
+	eventArgs.Add("label", serviceIdLabel+"="+serviceId)
+	messages, errs := api.client.Events(ctx, types.EventsOptions{Filters: eventArgs})
+
+	localNode := ""
+	info, err := api.client.Info(ctx)
+	if err == nil {
+		localNode = info.Swarm.NodeID
 	}
 
-	task := tasks[0]
+	taskArgs := filters.NewArgs()
+	taskArgs.Add("service", serviceId)
+	var tasks []swarm.Task
+	for {
+		listed, err := api.client.TaskList(ctx, types.TaskListOptions{Filters: taskArgs})
+		if err != nil {
+			return tasks, errors.Wrapf(err, "unable to inspect tasks for service %s", serviceId)
+		}
+		tasks = listed
+		observe(tasks)
+		if tasksDone(tasks, expected) {
+			return tasks, nil
+		}
 
-	switch task.Status.State {
-	case swarm.TaskStateFailed:
-		errC <- errors.Errorf("service failed")
-	case swarm.TaskStateRejected:
-		errC <- errors.Errorf("service rejected")
-	case swarm.TaskStateComplete:
-		doneC <- true
+		interval := taskPollInterval
+		if messages != nil && len(tasks) >= expected && tasksLocal(tasks, localNode) {
+			interval = taskCheckInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return tasks, ctx.Err()
+		case <-messages:
+		case err := <-errs:
+			if ctx.Err() != nil {
+				timer.Stop()
+				return tasks, ctx.Err()
+			}
+			LoggerFrom(ctx).WithError(err).Debug("unable to receive events, polling tasks")
+			messages, errs = nil, nil
+		case <-timer.C:
+		}
+		timer.Stop()
 	}
 }
 
-func (api *DockerApi) taskWait(ctx context.Context, serviceId string) error {
-	ticker := time.NewTicker(500 * time.Millisecond)
-	doneC := make(chan bool, 1)
-	errC := make(chan error, 1)
-	for {
-		select {
-		case <-ticker.C:
-			api.isTaskComplete(ctx, serviceId, doneC, errC)
-		case e := <-errC:
-			return e
-		case <-doneC:
-			return nil
+// tasksLocal returns whether the tasks still running all run on a node,
+// rather than on others or on none yet.
+func tasksLocal(tasks []swarm.Task, nodeId string) bool {
+	for _, task := range tasks {
+		if !terminalStates[task.Status.State] && (nodeId == "" || task.NodeID != nodeId) {
+			return false
 		}
 	}
+	return true
+}
+
+func (api *DockerApi) copyFileFromContainer(ctx context.Context, containerId string, path string) ([]byte, error) {
+	archive, _, err := api.client.CopyFromContainer(ctx, containerId, path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	return readFileFromTar(archive)
 }
 
-func (api *DockerApi) RunJobAsContainer(job Job) (out []byte, err error) {
+// containerExecutor runs a job in a container.
+type containerExecutor struct {
+	api         *DockerApi
+	containerId string
+}
 
-	ctx := context.Background()
+func newContainerExecutor(api *DockerApi) Executor {
+	return &containerExecutor{api: api}
+}
 
-	imageExists, err := api.imageExists(ctx, job.Image, job.Tag)
+// Prepare pulls the image of the job if missing, and creates its container.
+func (e *containerExecutor) Prepare(ctx context.Context, job Job) error {
+	imageExists, err := e.api.imageExists(ctx, job.Image, job.Tag)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if !imageExists {
-		err = api.pullImage(ctx, job.Image, job.Tag)
+		LoggerFrom(ctx).WithField("image", job.Image+":"+job.Tag).Info("pulling image")
+		err = e.api.pullImage(ctx, job.Image, job.Tag)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	createResponse, err := api.client.ContainerCreate(ctx, &container.Config{
+	createResponse, err := e.api.client.ContainerCreate(ctx, &container.Config{
 		Image: job.Image,
 		Cmd:   job.Cmd,
 		Env:   job.Env,
-	}, nil, nil, "")
+	}, nil, nil, nil, "")
 	if err != nil {
-		return nil, err
+		return err
 	}
+	e.containerId = createResponse.ID
+	LoggerFrom(ctx).WithField("container", e.containerId).Debug("container created")
+	return nil
+}
 
-	err = api.client.ContainerStart(ctx, createResponse.ID, types.ContainerStartOptions{})
-	if err != nil {
-		return nil, err
-	}
+func (e *containerExecutor) Start(ctx context.Context) error {
+	return e.api.client.ContainerStart(ctx, e.containerId, types.ContainerStartOptions{})
+}
 
-	resC, errC := api.client.ContainerWait(ctx, createResponse.ID, container.WaitConditionNextExit)
+func (e *containerExecutor) Wait(ctx context.Context) (int64, error) {
+	resC, errC := e.api.client.ContainerWait(ctx, e.containerId, container.WaitConditionNextExit)
 	select {
-	case <-resC:
-		break
+	case res := <-resC:
+		return res.StatusCode, nil
 	case err := <-errC:
-		return nil, err
+		return 0, err
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	}
+}
 
+func (e *containerExecutor) Logs(ctx context.Context) (io.ReadCloser, error) {
 	logOptions := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}
-	logResponse, err := api.client.ContainerLogs(ctx, createResponse.ID, logOptions)
-	if err != nil {
-		return nil, err
-	}
-	defer logResponse.Close()
+	return e.api.client.ContainerLogs(ctx, e.containerId, logOptions)
+}
 
-	response, err := ioutil.ReadAll(logResponse)
-	if err != nil {
-		return nil, err
-	}
+// FollowLogs streams the logs of the container from its start, until it
+// exits.
+func (e *containerExecutor) FollowLogs(ctx context.Context) (io.ReadCloser, error) {
+	logOptions := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true}
+	return e.api.client.ContainerLogs(ctx, e.containerId, logOptions)
+}
 
-	api.client.ContainerRemove(ctx, createResponse.ID, types.ContainerRemoveOptions{})
+func (e *containerExecutor) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return e.api.copyFileFromContainer(ctx, e.containerId, path)
+}
 
-	return response, nil
+// Cleanup removes the container, even if still running.
+func (e *containerExecutor) Cleanup(ctx context.Context) error {
+	return e.api.client.ContainerRemove(ctx, e.containerId, types.ContainerRemoveOptions{Force: true})
 }
 
-func (api *DockerApi) RunJobAsService(job Job) (out []byte, err error) {
+// serviceExecutor runs a job as a swarm service, either with a number of
+// replicas or globally, with a task on every node.
+type serviceExecutor struct {
+	api           *DockerApi
+	spec          swarm.ServiceSpec
+	expected      int
+	minSuccessful int
+	serviceId     string
+	tasks         []swarm.Task
+	timelines     map[string][]TaskTransition
+	hostnames     map[string]string
+}
 
-	ctx := context.Background()
+func newServiceExecutor(api *DockerApi) Executor {
+	return &serviceExecutor{
+		api:       api,
+		timelines: map[string][]TaskTransition{},
+		hostnames: map[string]string{},
+	}
+}
 
-	replicas := uint64(1)
-	replicatedOptions := &swarm.ReplicatedService{
-		Replicas: &replicas,
+// Prepare builds the spec of the service, the image being pulled by the nodes
+// running its tasks.
+func (e *serviceExecutor) Prepare(ctx context.Context, job Job) error {
+	// job modes run the tasks to completion natively, while older daemons
+	// run a service whose tasks are never restarted
+	jobModes := e.api.jobModes()
+	mode := swarm.ServiceMode{}
+	if job.Mode == ModeGlobal {
+		if jobModes {
+			mode.GlobalJob = &swarm.GlobalJob{}
+		} else {
+			mode.Global = &swarm.GlobalService{}
+		}
+		expected, err := e.api.eligibleNodes(ctx, job.Constraints)
+		if err != nil {
+			return err
+		}
+		if expected == 0 {
+			return errors.New("no node is eligible to run the tasks of the service")
+		}
+		e.expected = expected
+	} else {
+		replicas := uint64(1)
+		if job.Replicas > 0 {
+			replicas = uint64(job.Replicas)
+		}
+		if jobModes {
+			mode.ReplicatedJob = &swarm.ReplicatedJob{MaxConcurrent: &replicas, TotalCompletions: &replicas}
+		} else {
+			mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+		}
+		e.expected = int(replicas)
 	}
+	e.minSuccessful = job.MinSuccessful
 
 	containerSpec := &swarm.ContainerSpec{
 		Image:   job.Image,
@@ -175,35 +383,192 @@ func (api *DockerApi) RunJobAsService(job Job) (out []byte, err error) {
 		Placement:     placement,
 	}
 
-	createResponse, err := api.client.ServiceCreate(ctx, swarm.ServiceSpec{
-		Mode:         swarm.ServiceMode{Replicated: replicatedOptions},
+	e.spec = swarm.ServiceSpec{
+		Mode:         mode,
 		TaskTemplate: taskTemplate,
-	}, types.ServiceCreateOptions{})
+	}
+	return nil
+}
+
+// Start creates the service, which starts its tasks.
+func (e *serviceExecutor) Start(ctx context.Context) error {
+	createResponse, err := e.api.client.ServiceCreate(ctx, e.spec, types.ServiceCreateOptions{})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	e.serviceId = createResponse.ID
+	LoggerFrom(ctx).WithField("service", e.serviceId).Debug("service created")
+	return nil
+}
 
-	err = api.taskWait(ctx, createResponse.ID)
+// Wait waits for all the tasks to complete. The job succeeds when they all
+// do, or min_successful of them if set, and otherwise exits with the exit
+// code of the first failed task, or 1 if it has none.
+func (e *serviceExecutor) Wait(ctx context.Context) (int64, error) {
+	tasks, err := e.api.tasksWait(ctx, e.serviceId, e.expected, func(tasks []swarm.Task) {
+		e.observe(ctx, tasks)
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	succeeded := 0
+	exitCode := int64(0)
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateComplete {
+			succeeded++
+			continue
+		}
+		LoggerFrom(ctx).WithFields(logrus.Fields{
+			"task":  task.ID,
+			"node":  e.hostnames[task.NodeID],
+			"state": task.Status.State,
+			"error": task.Status.Err,
+		}).Warn("task did not complete")
+		if exitCode == 0 {
+			if task.Status.ContainerStatus != nil {
+				exitCode = int64(task.Status.ContainerStatus.ExitCode)
+			}
+			if exitCode == 0 {
+				exitCode = 1
+			}
+		}
+	}
+
+	required := len(tasks)
+	if e.minSuccessful > 0 && e.minSuccessful < required {
+		required = e.minSuccessful
+	}
+	if succeeded >= required {
+		return 0, nil
 	}
+	return exitCode, nil
+}
+
+// observe records a listing of the tasks, the state they went through and
+// the hostname of their nodes.
+func (e *serviceExecutor) observe(ctx context.Context, tasks []swarm.Task) {
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].NodeID != tasks[j].NodeID {
+			return tasks[i].NodeID < tasks[j].NodeID
+		}
+		return tasks[i].Slot < tasks[j].Slot
+	})
+	e.tasks = tasks
+
+	for _, task := range tasks {
+		timeline := e.timelines[task.ID]
+		if len(timeline) == 0 || timeline[len(timeline)-1].State != string(task.Status.State) {
+			e.timelines[task.ID] = append(timeline, TaskTransition{
+				Time:    task.Status.Timestamp,
+				State:   string(task.Status.State),
+				Message: task.Status.Message,
+				Error:   task.Status.Err,
+			})
+		}
+		if _, ok := e.hostnames[task.NodeID]; !ok && task.NodeID != "" {
+			e.hostnames[task.NodeID] = e.api.nodeHostname(ctx, task.NodeID)
+		}
+	}
+}
+
+// Tasks returns the record of the tasks last listed.
+func (e *serviceExecutor) Tasks() []TaskRecord {
+	records := make([]TaskRecord, len(e.tasks))
+	for i, task := range e.tasks {
+		records[i] = TaskRecord{
+			ID:       task.ID,
+			Slot:     task.Slot,
+			NodeID:   task.NodeID,
+			Node:     e.hostnames[task.NodeID],
+			State:    string(task.Status.State),
+			Message:  task.Status.Message,
+			Error:    task.Status.Err,
+			Timeline: e.timelines[task.ID],
+		}
+		if status := task.Status.ContainerStatus; status != nil {
+			records[i].ContainerID = status.ContainerID
+			records[i].ExitCode = status.ExitCode
+		}
+	}
+	return records
+}
 
+// Logs returns the logs of the service, each line labelled with the node and
+// the slot of its task when there are several tasks.
+func (e *serviceExecutor) Logs(ctx context.Context) (io.ReadCloser, error) {
 	logOptions := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}
-	logResponse, err := api.client.ServiceLogs(ctx, createResponse.ID, logOptions)
-	if err != nil {
-		return nil, err
+	if len(e.tasks) <= 1 {
+		return e.api.client.ServiceLogs(ctx, e.serviceId, logOptions)
 	}
-	defer logResponse.Close()
 
-	response, err := ioutil.ReadAll(logResponse)
-	if err != nil {
-		return nil, err
+	r, w := io.Pipe()
+	go func() {
+		stdout := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+		stderr := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+		var err error
+		for _, task := range e.tasks {
+			var logs io.ReadCloser
+			logs, err = e.api.client.TaskLogs(ctx, task.ID, logOptions)
+			if err != nil {
+				break
+			}
+			label := e.taskLabel(task)
+			_, err = stdcopy.StdCopy(newLabelWriter(stdout, label), newLabelWriter(stderr, label), logs)
+			logs.Close()
+			if err != nil {
+				break
+			}
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// Cleanup removes the service, if it was created.
+func (e *serviceExecutor) Cleanup(ctx context.Context) error {
+	if e.serviceId == "" {
+		return nil
 	}
+	return e.api.client.ServiceRemove(ctx, e.serviceId)
+}
 
-	err = api.client.ServiceRemove(ctx, createResponse.ID)
-	if err != nil {
-		return nil, err
+// taskLabel names a task by the hostname of its node, and its slot for
+// replicated services.
+func (e *serviceExecutor) taskLabel(task swarm.Task) string {
+	node := e.hostnames[task.NodeID]
+	if node == "" {
+		node = task.NodeID
 	}
+	if task.Slot > 0 {
+		return fmt.Sprintf("%d@%s", task.Slot, node)
+	}
+	return node
+}
 
-	return response, nil
+// labelWriter prefixes every line written with a label.
+type labelWriter struct {
+	w         io.Writer
+	label     []byte
+	lineStart bool
+}
+
+func newLabelWriter(w io.Writer, label string) *labelWriter {
+	return &labelWriter{w: w, label: []byte(label + " | "), lineStart: true}
+}
+
+func (l *labelWriter) Write(p []byte) (int, error) {
+	var out []byte
+	for _, c := range p {
+		if l.lineStart {
+			out = append(out, l.label...)
+		}
+		out = append(out, c)
+		l.lineStart = c == '\n'
+	}
+	_, err := l.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
@@ -0,0 +1,537 @@
+// Package dockerfake is an in-memory docker daemon implementing
+// lib.DockerClient, to run jobs without a daemon. Containers and service
+// tasks behave as configured for their image: they exit with a given code
+// after a delay, write given logs and files, and tasks go through given
+// states.
+package dockerfake
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/pkg/stdcopy"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/palicao/docker-executor/lib"
+)
+
+var _ lib.DockerClient = (*Client)(nil)
+
+// Behavior is how the containers and service tasks of an image behave.
+type Behavior struct {
+	// ExitCode is the exit code of the containers.
+	ExitCode int64
+	// Delay is how long containers and service tasks run before exiting.
+	Delay time.Duration
+	// Stdout and Stderr are the logs of the containers and services.
+	Stdout string
+	Stderr string
+	// Files are the contents of the files which can be copied from the
+	// containers, by path.
+	Files map[string]string
+	// TaskStates are the states a service task goes through, one per task
+	// listing, staying in the last one. A task completes right away if empty.
+	TaskStates []swarm.TaskState
+	// TaskErr is the error of a failed, rejected or pending task.
+	TaskErr string
+	// FailedTasks is the number of tasks of a service which fail once done,
+	// exiting with ExitCode, the others going through TaskStates.
+	FailedTasks int
+}
+
+// Container is a container created on the fake daemon.
+type Container struct {
+	ID       string
+	Config   container.Config
+	Behavior Behavior
+	Started  bool
+	Removed  bool
+	exited   chan struct{}
+	exit     sync.Once
+}
+
+// stop makes the container exit, if it didn't already.
+func (ctr *Container) stop() {
+	ctr.exit.Do(func() {
+		close(ctr.exited)
+	})
+}
+
+// Service is a service created on the fake daemon.
+type Service struct {
+	ID       string
+	Spec     swarm.ServiceSpec
+	Behavior Behavior
+	Removed  bool
+	listings int
+}
+
+// Client is a fake docker daemon. Its fields can be inspected once jobs ran.
+type Client struct {
+	mu sync.Mutex
+	// Images are the images present, as image:tag.
+	Images map[string]bool
+	// PullErrors are the errors pulling images fails with, by image:tag.
+	PullErrors map[string]error
+	// Behaviors are the behaviors of the containers and services, by image.
+	Behaviors map[string]Behavior
+	// APIVersion is the API version negotiated with the daemon, the job
+	// service modes being refused before 1.41.
+	APIVersion string
+	// PingErr is the error pinging the daemon fails with, if any.
+	PingErr error
+	// Manager tells whether the daemon is a swarm manager.
+	Manager bool
+	// EventsErr is the error the events stream fails with, if any.
+	EventsErr error
+	// Nodes are the nodes of the swarm, running a task each for global
+	// services. Replicated tasks are spread over them.
+	Nodes []string
+	// Hostnames are the hostnames of the nodes, by id.
+	Hostnames map[string]string
+	// Pulls are the images pulled, in order.
+	Pulls      []string
+	Containers map[string]*Container
+	Services   map[string]*Service
+	lastId     int
+}
+
+// New returns a fake daemon of a single node, without images: containers and services exit
+// successfully without output unless configured otherwise.
+func New() *Client {
+	return &Client{
+		APIVersion: "1.41",
+		Manager:    true,
+		Images:     map[string]bool{},
+		Nodes:      []string{"node1"},
+		Hostnames:  map[string]string{},
+		PullErrors: map[string]error{},
+		Behaviors:  map[string]Behavior{},
+		Containers: map[string]*Container{},
+		Services:   map[string]*Service{},
+	}
+}
+
+// SetBehavior sets the behavior of the containers and services of an image.
+func (c *Client) SetBehavior(image string, behavior Behavior) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Behaviors[image] = behavior
+}
+
+func (c *Client) newId(prefix string) string {
+	c.lastId++
+	return fmt.Sprintf("%s%d", prefix, c.lastId)
+}
+
+func (c *Client) container(id string) (*Container, error) {
+	ctr, ok := c.Containers[id]
+	if !ok || ctr.Removed {
+		return nil, fmt.Errorf("No such container: %s", id)
+	}
+	return ctr, nil
+}
+
+func (c *Client) service(id string) (*Service, error) {
+	service, ok := c.Services[id]
+	if !ok || service.Removed {
+		return nil, fmt.Errorf("service %s not found", id)
+	}
+	return service, nil
+}
+
+// logs returns logs multiplexed as the docker ones.
+func logs(behavior Behavior) io.ReadCloser {
+	var buf bytes.Buffer
+	stdcopy.NewStdWriter(&buf, stdcopy.Stdout).Write([]byte(behavior.Stdout))
+	stdcopy.NewStdWriter(&buf, stdcopy.Stderr).Write([]byte(behavior.Stderr))
+	return ioutil.NopCloser(&buf)
+}
+
+func (c *Client) ClientVersion() string {
+	return c.APIVersion
+}
+
+func (c *Client) Ping(ctx context.Context) (types.Ping, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.PingErr != nil {
+		return types.Ping{}, c.PingErr
+	}
+	return types.Ping{APIVersion: c.APIVersion, OSType: "linux"}, nil
+}
+
+func (c *Client) Info(ctx context.Context) (types.Info, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.PingErr != nil {
+		return types.Info{}, c.PingErr
+	}
+	info := types.Info{ID: "fake", Name: c.Nodes[0], ServerVersion: "fake"}
+	info.Swarm.LocalNodeState = swarm.LocalNodeStateActive
+	info.Swarm.ControlAvailable = c.Manager
+	info.Swarm.NodeID = c.Nodes[0]
+	return info, nil
+}
+
+// Events streams a die event for every service filtered on by label, once
+// the delay of its containers elapsed.
+func (c *Client) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+
+	c.mu.Lock()
+	eventsErr := c.EventsErr
+	var services []*Service
+	for _, label := range options.Filters.Get("label") {
+		parts := strings.SplitN(label, "=", 2)
+		if service, ok := c.Services[parts[len(parts)-1]]; ok {
+			services = append(services, service)
+		}
+	}
+	c.mu.Unlock()
+	if eventsErr != nil {
+		errs <- eventsErr
+		close(errs)
+		return messages, errs
+	}
+
+	go func() {
+		defer close(errs)
+		for _, service := range services {
+			select {
+			case <-time.After(service.Behavior.Delay):
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+			message := events.Message{
+				Type:   events.ContainerEventType,
+				Action: "die",
+				Actor: events.Actor{
+					ID:         service.ID + ".container",
+					Attributes: map[string]string{"com.docker.swarm.service.id": service.ID},
+				},
+			}
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return messages, errs
+}
+
+func (c *Client) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var images []types.ImageSummary
+	for _, ref := range options.Filters.Get("reference") {
+		if c.Images[ref] {
+			images = append(images, types.ImageSummary{ID: "sha256:" + ref, RepoTags: []string{ref}})
+		}
+	}
+	return images, nil
+}
+
+func (c *Client) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Pulls = append(c.Pulls, ref)
+	if err := c.PullErrors[ref]; err != nil {
+		return nil, err
+	}
+	c.Images[ref] = true
+	return ioutil.NopCloser(bytes.NewBufferString(`{"status":"Downloaded newer image for ` + ref + `"}`)), nil
+}
+
+func (c *Client) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.newId("container")
+	c.Containers[id] = &Container{ID: id, Config: *config, Behavior: c.Behaviors[config.Image], exited: make(chan struct{})}
+	return container.ContainerCreateCreatedBody{ID: id}, nil
+}
+
+func (c *Client) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.container(containerID)
+	if err != nil {
+		return err
+	}
+	ctr.Started = true
+	time.AfterFunc(ctr.Behavior.Delay, ctr.stop)
+	return nil
+}
+
+// ContainerWait waits for the container to exit, its delay after being
+// started.
+func (c *Client) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	resC := make(chan container.ContainerWaitOKBody, 1)
+	errC := make(chan error, 1)
+
+	c.mu.Lock()
+	ctr, err := c.container(containerID)
+	c.mu.Unlock()
+	if err != nil {
+		errC <- err
+		return resC, errC
+	}
+
+	go func() {
+		select {
+		case <-ctr.exited:
+			resC <- container.ContainerWaitOKBody{StatusCode: ctr.Behavior.ExitCode}
+		case <-ctx.Done():
+			errC <- ctx.Err()
+		}
+	}()
+	return resC, errC
+}
+
+// ContainerLogs returns the logs of the container. Followed logs are written
+// right away, the stream ending once the container exits.
+func (c *Client) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.container(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if !options.Follow {
+		return logs(ctr.Behavior), nil
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		_, err := io.Copy(w, logs(ctr.Behavior))
+		if err == nil {
+			select {
+			case <-ctr.exited:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func (c *Client) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.container(containerID)
+	if err != nil {
+		return err
+	}
+	ctr.Removed = true
+	ctr.stop()
+	return nil
+}
+
+// CopyFromContainer returns a tar archive of a file of the container.
+func (c *Client) CopyFromContainer(ctx context.Context, containerID string, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.container(containerID)
+	if err != nil {
+		return nil, types.ContainerPathStat{}, err
+	}
+	content, ok := ctr.Behavior.Files[srcPath]
+	if !ok {
+		return nil, types.ContainerPathStat{}, fmt.Errorf("Could not find the file %s in container %s", srcPath, containerID)
+	}
+
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	name := path.Base(srcPath)
+	err = archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	if err == nil {
+		_, err = archive.Write([]byte(content))
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		return nil, types.ContainerPathStat{}, err
+	}
+	return ioutil.NopCloser(&buf), types.ContainerPathStat{Name: name, Size: int64(len(content))}, nil
+}
+
+func (c *Client) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (service.Mode.ReplicatedJob != nil || service.Mode.GlobalJob != nil) && versions.LessThan(c.APIVersion, "1.41") {
+		return types.ServiceCreateResponse{}, fmt.Errorf("job service modes require API version 1.41, not %s", c.APIVersion)
+	}
+	image := ""
+	if service.TaskTemplate.ContainerSpec != nil {
+		image = service.TaskTemplate.ContainerSpec.Image
+	}
+	id := c.newId("service")
+	c.Services[id] = &Service{ID: id, Spec: service, Behavior: c.Behaviors[image]}
+	return types.ServiceCreateResponse{ID: id}, nil
+}
+
+// terminal are the task states reached once the container exited.
+var terminal = map[swarm.TaskState]bool{
+	swarm.TaskStateComplete: true,
+	swarm.TaskStateFailed:   true,
+	swarm.TaskStateShutdown: true,
+}
+
+// tasks returns the tasks of a service, in their state after a number of
+// listings.
+func (c *Client) tasks(service *Service, listings int) []swarm.Task {
+	mode := service.Spec.Mode
+	global := mode.Global != nil || mode.GlobalJob != nil
+	count := 1
+	if global {
+		count = len(c.Nodes)
+	} else if mode.Replicated != nil && mode.Replicated.Replicas != nil {
+		count = int(*mode.Replicated.Replicas)
+	} else if mode.ReplicatedJob != nil && mode.ReplicatedJob.TotalCompletions != nil {
+		count = int(*mode.ReplicatedJob.TotalCompletions)
+	}
+
+	state := swarm.TaskStateComplete
+	if states := service.Behavior.TaskStates; len(states) > 0 {
+		state = states[len(states)-1]
+		if listings < len(states) {
+			state = states[listings]
+		}
+	}
+
+	tasks := make([]swarm.Task, count)
+	for i := range tasks {
+		task := swarm.Task{
+			ID:           fmt.Sprintf("%s.task%d", service.ID, i+1),
+			ServiceID:    service.ID,
+			NodeID:       c.Nodes[i%len(c.Nodes)],
+			Status:       swarm.TaskStatus{Timestamp: time.Now(), State: state, Message: string(state)},
+			DesiredState: swarm.TaskStateRunning,
+		}
+		if !global {
+			task.Slot = i + 1
+		}
+		if state == swarm.TaskStateRunning || terminal[state] {
+			task.Status.ContainerStatus = &swarm.ContainerStatus{ContainerID: fmt.Sprintf("%s.container%d", service.ID, i+1)}
+		}
+		if i < service.Behavior.FailedTasks && state == swarm.TaskStateComplete {
+			task.Status.State = swarm.TaskStateFailed
+			task.Status.Message = string(swarm.TaskStateFailed)
+			task.Status.ContainerStatus.ExitCode = int(service.Behavior.ExitCode)
+		}
+		if task.Status.State == swarm.TaskStateFailed || task.Status.State == swarm.TaskStateRejected || task.Status.State == swarm.TaskStatePending {
+			task.Status.Err = service.Behavior.TaskErr
+		}
+		tasks[i] = task
+	}
+	return tasks
+}
+
+// TaskList returns the tasks of the services filtered on, in their next
+// state.
+func (c *Client) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tasks []swarm.Task
+	for _, id := range options.Filters.Get("service") {
+		service, ok := c.Services[id]
+		if !ok || service.Removed {
+			continue
+		}
+		tasks = append(tasks, c.tasks(service, service.listings)...)
+		service.listings++
+	}
+	return tasks, nil
+}
+
+// TaskLogs returns the logs of a task, the ones of its service.
+func (c *Client) TaskLogs(ctx context.Context, taskID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	service, err := c.service(strings.SplitN(taskID, ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("task %s not found", taskID)
+	}
+	return logs(service.Behavior), nil
+}
+
+// node returns a node of the swarm, ready and active, whose hostname is its
+// id unless given in Hostnames. The first node is the manager.
+func (c *Client) node(id string) swarm.Node {
+	hostname := c.Hostnames[id]
+	if hostname == "" {
+		hostname = id
+	}
+	node := swarm.Node{ID: id, Description: swarm.NodeDescription{Hostname: hostname}}
+	node.Spec.Role = swarm.NodeRoleWorker
+	if id == c.Nodes[0] {
+		node.Spec.Role = swarm.NodeRoleManager
+	}
+	node.Spec.Availability = swarm.NodeAvailabilityActive
+	node.Status.State = swarm.NodeStateReady
+	return node
+}
+
+// NodeList returns the nodes of the swarm.
+func (c *Client) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]swarm.Node, len(c.Nodes))
+	for i, id := range c.Nodes {
+		nodes[i] = c.node(id)
+	}
+	return nodes, nil
+}
+
+func (c *Client) NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range c.Nodes {
+		if id == nodeID {
+			return c.node(id), []byte(`{"ID":"` + id + `"}`), nil
+		}
+	}
+	return swarm.Node{}, nil, fmt.Errorf("node %s not found", nodeID)
+}
+
+func (c *Client) ServiceLogs(ctx context.Context, serviceID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	service, err := c.service(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	return logs(service.Behavior), nil
+}
+
+func (c *Client) ServiceRemove(ctx context.Context, serviceID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	service, err := c.service(serviceID)
+	if err != nil {
+		return err
+	}
+	service.Removed = true
+	return nil
+}
@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultLogLines = 20
+
+const defaultEmailSubject = `[docker-executor] job {{ .Run.JobName }}: {{ .Event }}`
+
+const defaultEmailText = `Job {{ .Run.JobName }} {{ .Event }}.
+
+Run:       {{ .Run.ID }}
+Trigger:   {{ .Run.Trigger }}
+Started:   {{ .Run.StartTime.Format "2006-01-02 15:04:05 MST" }}
+Duration:  {{ .Run.Duration }}
+Exit code: {{ .Run.ExitCode }}
+{{ if .Run.Error }}Error:     {{ .Run.Error }}
+{{ end }}
+{{ if .Output }}Last lines of output:
+
+{{ range .Output }}{{ . }}
+{{ end }}{{ end }}`
+
+const defaultEmailHtml = `<p>Job <strong>{{ .Run.JobName }}</strong> {{ .Event }}.</p>
+<table>
+<tr><td>Run</td><td>{{ .Run.ID }}</td></tr>
+<tr><td>Trigger</td><td>{{ .Run.Trigger }}</td></tr>
+<tr><td>Started</td><td>{{ .Run.StartTime.Format "2006-01-02 15:04:05 MST" }}</td></tr>
+<tr><td>Duration</td><td>{{ .Run.Duration }}</td></tr>
+<tr><td>Exit code</td><td>{{ .Run.ExitCode }}</td></tr>
+{{ if .Run.Error }}<tr><td>Error</td><td>{{ .Run.Error }}</td></tr>{{ end }}
+</table>
+{{ if .Output }}<p>Last lines of output:</p>
+<pre>{{ range .Output }}{{ . }}
+{{ end }}</pre>{{ end }}`
+
+// Smtp is the server email notifications are sent through.
+type Smtp struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	StartTls bool   `yaml:"starttls"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// Email sends a message describing a run, with the last lines of its output,
+// to a list of recipients. Subject, text and html are templates getting a
+// Notification.
+type Email struct {
+	To       []string `yaml:"to"`
+	On       []string `yaml:"on"`
+	LogLines int      `yaml:"log_lines"`
+	Subject  string   `yaml:"subject"`
+	Text     string   `yaml:"text"`
+	Html     string   `yaml:"html"`
+}
+
+func validateSmtp(server *Smtp) error {
+	if server.Host == "" {
+		return errors.New("smtp host must not be empty")
+	}
+	if server.Port <= 0 || server.Port > 65535 {
+		return errors.New("smtp port must be between 1 and 65535")
+	}
+	_, err := mail.ParseAddress(server.From)
+	if err != nil {
+		return errors.Wrap(err, "smtp from must be a valid address")
+	}
+	return nil
+}
+
+func validateEmail(email Email) error {
+	if len(email.To) == 0 {
+		return errors.New("email recipients must not be empty")
+	}
+	for _, to := range email.To {
+		_, err := mail.ParseAddress(to)
+		if err != nil {
+			return errors.Wrapf(err, "invalid email recipient %s", to)
+		}
+	}
+	err := validateEvents(email.On)
+	if err != nil {
+		return err
+	}
+	if email.LogLines < 0 {
+		return errors.New("email log_lines must not be negative")
+	}
+	for _, text := range []string{email.Subject, email.Text} {
+		_, err = template.New("").Parse(text)
+		if err != nil {
+			return errors.Wrap(err, "invalid email template")
+		}
+	}
+	_, err = htmltemplate.New("").Parse(email.Html)
+	if err != nil {
+		return errors.Wrap(err, "invalid email template")
+	}
+	return nil
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func renderText(text string, data interface{}) (string, error) {
+	tpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func renderHtml(text string, data interface{}) (string, error) {
+	tpl, err := htmltemplate.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func writePart(w *multipart.Writer, contentType string, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write([]byte(body))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// emailMessage builds a multipart/alternative message with a text and an
+// html version of the notification.
+func emailMessage(server *Smtp, email Email, notification Notification) ([]byte, error) {
+	lines := email.LogLines
+	if lines == 0 {
+		lines = defaultLogLines
+	}
+	if len(notification.Output) > lines {
+		notification.Output = notification.Output[len(notification.Output)-lines:]
+	}
+
+	subject, err := renderText(orDefault(email.Subject, defaultEmailSubject), notification)
+	if err != nil {
+		return nil, err
+	}
+	text, err := renderText(orDefault(email.Text, defaultEmailText), notification)
+	if err != nil {
+		return nil, err
+	}
+	html, err := renderHtml(orDefault(email.Html, defaultEmailHtml), notification)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	err = writePart(w, "text/plain", text)
+	if err != nil {
+		return nil, err
+	}
+	err = writePart(w, "text/html", html)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + server.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(email.To, ", ") + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: multipart/alternative; boundary=" + w.Boundary() + "\r\n")
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// sendEmail delivers a message through the smtp server, upgrading the
+// connection with STARTTLS and authenticating when configured.
+func sendEmail(server *Smtp, to []string, msg []byte) error {
+	c, err := smtp.Dial(net.JoinHostPort(server.Host, strconv.Itoa(server.Port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if server.StartTls {
+		err = c.StartTLS(&tls.Config{ServerName: server.Host})
+		if err != nil {
+			return err
+		}
+	}
+	if server.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", server.Username, server.Password, server.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(server.From)
+	err = c.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		address, _ := mail.ParseAddress(recipient)
+		err = c.Rcpt(address.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
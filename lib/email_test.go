@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// delivery is what a smtpServer got over a connection.
+type delivery struct {
+	auth string
+	from string
+	to   []string
+	data string
+	quit bool
+}
+
+// smtpServer is a minimal smtp server accepting every message, refusing the
+// recipients in reject.
+type smtpServer struct {
+	listener   net.Listener
+	reject     string
+	deliveries chan delivery
+}
+
+func newSmtpServer(t *testing.T, reject string) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: listener, reject: reject, deliveries: make(chan delivery, 10)}
+	go s.serve()
+	return s
+}
+
+// config returns the smtp configuration pointing at the server.
+func (s *smtpServer) config() *Smtp {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return &Smtp{Host: host, Port: p, From: "Executor <executor@example.com>"}
+}
+
+func (s *smtpServer) Close() {
+	s.listener.Close()
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(textproto.NewConn(conn))
+	}
+}
+
+func (s *smtpServer) handle(c *textproto.Conn) {
+	defer c.Close()
+	var d delivery
+	defer func() {
+		s.deliveries <- d
+	}()
+
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			d.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+			c.PrintfLine("235 authenticated")
+		case "MAIL":
+			d.from = line[len("MAIL FROM:"):]
+			c.PrintfLine("250 ok")
+		case "RCPT":
+			to := line[len("RCPT TO:"):]
+			if s.reject != "" && strings.Contains(to, s.reject) {
+				c.PrintfLine("550 no such user")
+				continue
+			}
+			d.to = append(d.to, to)
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			d.data = string(data)
+			c.PrintfLine("250 queued")
+		case "QUIT":
+			d.quit = true
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestEmailDelivery(t *testing.T) {
+	server := newSmtpServer(t, "")
+	defer server.Close()
+	smtp := server.config()
+	config := &Config{
+		Smtp: smtp,
+		Notifications: Notifications{Emails: []Email{
+			{To: []string{"Ops <ops@example.com>", "dev@example.com"}},
+		}},
+	}
+
+	NewNotifier(config).Notify(notifiedRun, nil, []byte("dumping\ndisk full\n"))
+	d := <-server.deliveries
+	if d.auth != "" {
+		t.Errorf("authenticated without a username: %s", d.auth)
+	}
+	if d.from != "<executor@example.com>" {
+		t.Errorf("from %s", d.from)
+	}
+	if strings.Join(d.to, ",") != "<ops@example.com>,<dev@example.com>" {
+		t.Errorf("recipients %v", d.to)
+	}
+	if !d.quit {
+		t.Error("connection not quit")
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(d.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("From") != smtp.From || msg.Header.Get("To") != "Ops <ops@example.com>, dev@example.com" {
+		t.Errorf("headers %v", msg.Header)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "[docker-executor] job backup: failure" {
+		t.Errorf("subject %s", subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type %s", msg.Header.Get("Content-Type"))
+	}
+	parts := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		parts[part.Header.Get("Content-Type")] = string(body)
+	}
+	text := parts["text/plain; charset=utf-8"]
+	for _, want := range []string{"Job backup failure.", "Run:       run-1", "Exit code: 2", "Error:     exited with code 2", "dumping\ndisk full\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text part %q missing %q", text, want)
+		}
+	}
+	html := parts["text/html; charset=utf-8"]
+	if !strings.Contains(html, "<strong>backup</strong>") || !strings.Contains(html, "<pre>dumping\ndisk full\n</pre>") {
+		t.Errorf("html part %q", html)
+	}
+}
+
+func TestEmailTemplates(t *testing.T) {
+	server := newSmtpServer(t, "")
+	defer server.Close()
+	smtp := server.config()
+	smtp.Username = "executor"
+	smtp.Password = "s3cret"
+	email := Email{
+		To:       []string{"ops@example.com"},
+		LogLines: 2,
+		Subject:  "{{ .Run.JobName }} — {{ .Event }}",
+		Text:     "{{ range .Output }}> {{ . }}\n{{ end }}",
+		Html:     "<p>{{ .Run.Error }}</p>",
+	}
+	notification := Notification{Event: EventFailure, Run: notifiedRun, Output: []string{"one", "two", "three"}}
+	notification.Run.Error = "<oom>"
+
+	msg, err := emailMessage(smtp, email, notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendEmail(smtp, email.To, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := <-server.deliveries
+	auth, _ := base64.StdEncoding.DecodeString(d.auth)
+	if string(auth) != "\x00executor\x00s3cret" {
+		t.Errorf("auth %q", auth)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(d.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != "backup — failure" {
+		t.Errorf("subject %s", subject)
+	}
+	body, _ := ioutil.ReadAll(m.Body)
+	if !strings.Contains(string(body), "> two\n> three") || strings.Contains(string(body), "> one") {
+		t.Errorf("log lines not limited to 2: %s", body)
+	}
+	if !strings.Contains(string(body), "<p>&lt;oom&gt;</p>") {
+		t.Errorf("html not escaped: %s", body)
+	}
+}
+
+func TestEmailRejected(t *testing.T) {
+	server := newSmtpServer(t, "nobody")
+	defer server.Close()
+
+	err := sendEmail(server.config(), []string{"ops@example.com", "nobody@example.com"}, []byte("Subject: test\r\n\r\nbody\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("error %v, want the recipient rejected", err)
+	}
+	d := <-server.deliveries
+	if d.data != "" {
+		t.Errorf("message delivered: %s", d.data)
+	}
+}
@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var variableRegexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces ${VAR} with the value of the environment variable
+// VAR, and ${VAR:-default} with default when VAR is unset or empty. $$
+// stands for a literal $. Variables without a default must be set, an unset
+// one being replaced with nothing. Comments are left as they are.
+func interpolate(filename string, in []byte, lookup func(string) (string, bool)) ([]byte, ConfigErrors) {
+	var errs ConfigErrors
+	var out bytes.Buffer
+	comments := findComments(in, ConfigFormat(filename))
+	line, lineStart, last := 1, 0, 0
+	for _, match := range variableRegexp.FindAllSubmatchIndex(in, -1) {
+		for len(comments) > 0 && comments[0][1] <= match[0] {
+			comments = comments[1:]
+		}
+		if len(comments) > 0 && comments[0][0] <= match[0] {
+			continue
+		}
+		out.Write(in[last:match[0]])
+		last = match[1]
+
+		line += bytes.Count(in[lineStart:match[0]], []byte("\n"))
+		if i := bytes.LastIndexByte(in[:match[0]], '\n'); i >= 0 {
+			lineStart = i + 1
+		}
+
+		if match[1]-match[0] == 2 {
+			out.WriteByte('$')
+			continue
+		}
+		name := string(in[match[2]:match[3]])
+		value, ok := lookup(name)
+		switch {
+		case match[4] >= 0 && value == "":
+			out.Write(in[match[6]:match[7]])
+		case ok:
+			out.WriteString(value)
+		default:
+			errs = append(errs, ConfigError{
+				File:    filename,
+				Line:    line,
+				Column:  match[0] - lineStart + 1,
+				Message: fmt.Sprintf("variable %s is not set", name),
+			})
+		}
+	}
+	out.Write(in[last:])
+	return out.Bytes(), errs
+}
+
+// findComments returns the start and end offsets of the comments of a yaml
+// or toml document: a # out of a quoted string, preceded by a space in yaml,
+// up to the end of the line. The content of yaml block scalars is not looked
+// into.
+func findComments(in []byte, format string) [][2]int {
+	if format == FormatJson {
+		return nil
+	}
+	yaml := format == FormatYaml
+	var comments [][2]int
+	block := -1
+	offset := 0
+	for _, line := range bytes.SplitAfter(in, []byte("\n")) {
+		start := offset
+		offset += len(line)
+		content := bytes.TrimLeft(line, " \t")
+		indent := len(line) - len(content)
+		if block >= 0 {
+			if len(bytes.TrimSpace(content)) == 0 || indent > block {
+				continue
+			}
+			block = -1
+		}
+		end := len(bytes.TrimRight(line, "\r\n"))
+		comment := lineComment(line[:end], yaml)
+		if comment >= 0 {
+			comments = append(comments, [2]int{start + comment, start + end})
+			end = comment
+		}
+		if yaml && blockScalarRegexp.Match(line[:end]) {
+			block = indent
+		}
+	}
+	return comments
+}
+
+var blockScalarRegexp = regexp.MustCompile(`(^|[:\-]\s)\s*[|>][0-9+\-]*\s*$`)
+
+// lineComment returns where the comment of a line starts, or -1 when it has
+// none. In yaml, only a quote starting a value starts a quoted string.
+func lineComment(line []byte, yaml bool) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && yaml && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '#':
+			if !yaml || i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+				return i
+			}
+		case c == '"' || c == '\'':
+			if !yaml || startsValue(line[:i]) {
+				quote = c
+			}
+		}
+	}
+	return -1
+}
+
+// startsValue tells whether what follows a part of a yaml line starts a
+// value.
+func startsValue(before []byte) bool {
+	before = bytes.TrimRight(before, " \t")
+	if len(before) == 0 {
+		return true
+	}
+	switch before[len(before)-1] {
+	case ':', '-', '[', '{', ',', '?':
+		return true
+	}
+	return false
+}
+
+// EnvList is the env of a job, given either as a list of KEY=value or as a
+// map of values by key.
+type EnvList []string
+
+func (env *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	err := unmarshal(&list)
+	if err == nil {
+		*env = list
+		return nil
+	}
+
+	var values map[string]interface{}
+	err = unmarshal(&values)
+	if err != nil {
+		return errors.New("env must be a list of KEY=value or a map")
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	*env = make(EnvList, len(keys))
+	for i, key := range keys {
+		value := values[key]
+		if value == nil {
+			value = ""
+		}
+		(*env)[i] = fmt.Sprintf("%s=%v", key, value)
+	}
+	return nil
+}
+
+// readEnvFile reads a file in the docker env-file format: a KEY=value per
+// line, ignoring blank lines and comments. A KEY alone takes the value from
+// the environment, and is left out when unset.
+func readEnvFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		key := parts[0]
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, errors.Errorf("%s:%d: invalid variable name %q", filename, n, key)
+		}
+		if len(parts) == 1 {
+			value, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			line = key + "=" + value
+		}
+		env = append(env, line)
+	}
+	return env, scanner.Err()
+}
+
+// mergeEnv returns the variables of base overridden by the ones of override
+// with the same key, in order.
+func mergeEnv(base []string, override []string) []string {
+	merged := []string{}
+	index := map[string]int{}
+	for _, e := range append(append([]string{}, base...), override...) {
+		key := strings.SplitN(e, "=", 2)[0]
+		if i, ok := index[key]; ok {
+			merged[i] = e
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// loadEnvFiles returns the env of a job, made of the variables of its env
+// files, relative to the config file dir, overridden by its env.
+func loadEnvFiles(job Job, dir string) (EnvList, error) {
+	if len(job.EnvFile) == 0 {
+		return job.Env, nil
+	}
+	var env []string
+	for _, filename := range job.EnvFile {
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		fileEnv, err := readEnvFile(filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read env file")
+		}
+		env = mergeEnv(env, fileEnv)
+	}
+	return mergeEnv(env, job.Env), nil
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestInterpolate(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		value, ok := map[string]string{"IMAGE": "alpine", "EMPTY": ""}[name]
+		return value, ok
+	}
+	tests := []struct {
+		name     string
+		filename string
+		in       string
+		want     string
+		errs     []string
+	}{
+		{"set", "config.yml", "image: ${IMAGE}\n", "image: alpine\n", nil},
+		{"default unused", "config.yml", "image: ${IMAGE:-busybox}\n", "image: alpine\n", nil},
+		{"default for unset", "config.yml", "image: ${NOPE:-busybox}\n", "image: busybox\n", nil},
+		{"default for empty", "config.yml", "image: ${EMPTY:-busybox}\n", "image: busybox\n", nil},
+		{"empty default", "config.yml", "tag: ${NOPE:-}\n", "tag: \n", nil},
+		{"empty", "config.yml", "tag: ${EMPTY}\n", "tag: \n", nil},
+		{"escaped", "config.yml", "cmd: [echo, $${IMAGE}, $$HOME, $HOME]\n", "cmd: [echo, ${IMAGE}, $HOME, $HOME]\n", nil},
+		{"yaml comment", "config.yml", "image: alpine # ${NOPE}\n# ${NOPE}\ntag: '#${IMAGE}'\n", "image: alpine # ${NOPE}\n# ${NOPE}\ntag: '#alpine'\n", nil},
+		{"yaml hash in a value", "config.yml", "url: http://host/#${IMAGE}\n", "url: http://host/#alpine\n", nil},
+		{"yaml block scalar", "config.yml", "cmd:\n  - |\n    echo # ${IMAGE}\n", "cmd:\n  - |\n    echo # alpine\n", nil},
+		{"toml comment", "config.toml", "image = \"#${IMAGE}\" # ${NOPE}\n", "image = \"#alpine\" # ${NOPE}\n", nil},
+		{"json has no comments", "config.json", "{\"image\": \"# ${IMAGE}\"}", "{\"image\": \"# alpine\"}", nil},
+		{
+			"unset", "config.yml", "jobs:\n  backup:\n    image: ${NOPE}\n    tag: ${IMAGE}-${ALSO_NOPE}\n",
+			"jobs:\n  backup:\n    image: \n    tag: alpine-\n",
+			[]string{"config.yml:3:12: configuration not valid: variable NOPE is not set", "config.yml:4:19: configuration not valid: variable ALSO_NOPE is not set"},
+		},
+	}
+	for _, test := range tests {
+		out, errs := interpolate(test.filename, []byte(test.in), lookup)
+		if string(out) != test.want {
+			t.Errorf("%s: interpolated %q, want %q", test.name, out, test.want)
+		}
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		if !reflect.DeepEqual(messages, test.errs) {
+			t.Errorf("%s: errors %q, want %q", test.name, messages, test.errs)
+		}
+	}
+}
+
+func TestFindComments(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		in     string
+		want   []string
+	}{
+		{"yaml", FormatYaml, "# top\nimage: alpine # end\n", []string{"# top", "# end"}},
+		{"yaml quoted", FormatYaml, "a: \"# no\" # yes\nb: 'it''s # no' # yes\n", []string{"# yes", "# yes"}},
+		{"yaml no space", FormatYaml, "url: http://host/#anchor\n", nil},
+		{"yaml quote in a value", FormatYaml, "msg: it's # yes\n", []string{"# yes"}},
+		{"yaml block scalar", FormatYaml, "cmd: |\n  # no\n  echo\n# yes\n", []string{"# yes"}},
+		{"yaml crlf", FormatYaml, "a: 1 # yes\r\n", []string{"# yes"}},
+		{"toml", FormatToml, "a = \"#no\"#yes\nb = '#no' # yes\n", []string{"#yes", "# yes"}},
+		{"json", FormatJson, "{\"a\": 1} # no\n", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, comment := range findComments([]byte(test.in), test.format) {
+			got = append(got, test.in[comment[0]:comment[1]])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: comments %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEnvListUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want EnvList
+		err  bool
+	}{
+		{"list", "env: [B=2, A=1]", EnvList{"B=2", "A=1"}, false},
+		{"map", "env: {B: 2, A: one, C: true, D: }", EnvList{"A=one", "B=2", "C=true", "D="}, false},
+		{"empty", "env: []", EnvList{}, false},
+		{"scalar", "env: A=1", nil, true},
+	}
+	for _, test := range tests {
+		var job Job
+		err := yaml.Unmarshal([]byte(test.in), &job)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(job.Env, test.want) {
+			t.Errorf("%s: env %q, want %q", test.name, job.Env, test.want)
+		}
+	}
+}
+
+func TestEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("base.env", "# comment\nA=1\n\n  B=two words\nC=\nFROM_ENV\nUNSET_IN_ENV\nD=x=y # not a comment\n")
+	write("override.env", "A=10\nE=5\n")
+	write("invalid.env", "A=1\nBAD KEY=1\n")
+	os.Setenv("FROM_ENV", "from env")
+	defer os.Unsetenv("FROM_ENV")
+	os.Unsetenv("UNSET_IN_ENV")
+
+	env, err := readEnvFile(filepath.Join(dir, "base.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"A=1", "B=two words", "C=", "FROM_ENV=from env", "D=x=y # not a comment"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("env %q, want %q", env, want)
+	}
+
+	_, err = readEnvFile(filepath.Join(dir, "invalid.env"))
+	if err == nil || !strings.Contains(err.Error(), "invalid.env:2: invalid variable name \"BAD KEY\"") {
+		t.Errorf("error %v", err)
+	}
+
+	job := Job{EnvFile: []string{"base.env", filepath.Join(dir, "override.env")}, Env: EnvList{"E=50", "F=6"}}
+	env, err = loadEnvFiles(job, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"A=10", "B=two words", "C=", "FROM_ENV=from env", "D=x=y # not a comment", "E=50", "F=6"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("env %q, want %q", env, want)
+	}
+
+	job.EnvFile = []string{"missing.env"}
+	_, err = loadEnvFiles(job, dir)
+	if err == nil || !strings.Contains(err.Error(), "unable to read env file") {
+		t.Errorf("error %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Executor runs a job, once: an executor is created for every run. Cleanup is
+// called once Prepare succeeded, whatever happens next.
+type Executor interface {
+	// Prepare gets everything ready to start the job, such as its image.
+	Prepare(ctx context.Context, job Job) error
+	// Start starts the job.
+	Start(ctx context.Context) error
+	// Wait waits for the job to complete, returning its exit code.
+	Wait(ctx context.Context) (int64, error)
+	// Logs returns the output of the completed job, multiplexed as the docker
+	// logs are.
+	Logs(ctx context.Context) (io.ReadCloser, error)
+	// Cleanup removes what was created to run the job.
+	Cleanup(ctx context.Context) error
+}
+
+// FileReader is implemented by the executors able to read a file written by
+// the job, to take its output from.
+type FileReader interface {
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+}
+
+// LogFollower is implemented by the executors able to stream the output of
+// the job while it runs, the stream ending once the job exits. The output of
+// the other executors is read once the job completed.
+type LogFollower interface {
+	FollowLogs(ctx context.Context) (io.ReadCloser, error)
+}
+
+// TaskReporter is implemented by the executors running a job as tasks, which
+// are recorded in the run, whether it succeeded or not.
+type TaskReporter interface {
+	Tasks() []TaskRecord
+}
+
+// ExecutorFactory creates the executor of a run.
+type ExecutorFactory func(api *DockerApi) Executor
+
+// executors are the factories of the executors, by job type.
+var executors = map[string]ExecutorFactory{
+	JobTypeRun:     newContainerExecutor,
+	JobTypeService: newServiceExecutor,
+}
+
+// RegisterExecutor makes a job type run by the executors of a factory,
+// replacing the one registered before, if any.
+func RegisterExecutor(jobType string, factory ExecutorFactory) {
+	executors[jobType] = factory
+}
+
+// NewExecutor creates the executor of a run of a job type.
+func NewExecutor(jobType string, api *DockerApi) (Executor, error) {
+	factory, ok := executors[jobType]
+	if !ok {
+		return nil, errors.Errorf("no executor for job type %s", jobType)
+	}
+	return factory(api), nil
+}
+
+// JobTypes returns the job types an executor is registered for, sorted.
+func JobTypes() []string {
+	types := make([]string, 0, len(executors))
+	for jobType := range executors {
+		types = append(types, jobType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func validateType(jobType string) error {
+	if _, ok := executors[jobType]; ok {
+		return nil
+	}
+	types := JobTypes()
+	if len(types) == 1 {
+		return errors.Errorf("type can only be %s", types[0])
+	}
+	return errors.Errorf("type can only be %s or %s", strings.Join(types[:len(types)-1], ", "), types[len(types)-1])
+}
+
+// RunJob runs a job with an executor and waits for it to complete, reading
+// its logs into the capture. What the executor created is cleaned up once
+// done, even when the context is cancelled. The result holds the tasks of the
+// job, if any, even when it fails, and its exit code and logs when only
+// taking its output failed.
+func RunJob(ctx context.Context, executor Executor, job Job, capture *Capture) (*JobResult, error) {
+	result, err := runJob(ctx, executor, job, capture)
+	reporter, ok := executor.(TaskReporter)
+	if !ok {
+		return result, err
+	}
+	tasks := reporter.Tasks()
+	if len(tasks) == 0 {
+		return result, err
+	}
+	if result == nil {
+		result = &JobResult{}
+	}
+	result.Tasks = tasks
+	return result, err
+}
+
+func runJob(ctx context.Context, executor Executor, job Job, capture *Capture) (*JobResult, error) {
+	err := executor.Prepare(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := executor.Cleanup(context.Background())
+		if err != nil {
+			LoggerFrom(ctx).WithError(err).Warn("unable to clean up job")
+		}
+	}()
+
+	err = executor.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var following io.ReadCloser
+	var followed chan error
+	if follower, ok := executor.(LogFollower); ok {
+		following, err = follower.FollowLogs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer following.Close()
+		followed = make(chan error, 1)
+		go func() {
+			followed <- capture.read(following)
+		}()
+	}
+
+	exitCode, err := executor.Wait(ctx)
+	if followed != nil {
+		if err != nil {
+			following.Close()
+		}
+		readErr := <-followed
+		if err == nil {
+			err = readErr
+		}
+	} else if err == nil {
+		err = readLogs(ctx, executor, capture)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &JobResult{ExitCode: exitCode}
+	result.Logs, result.Truncated = capture.Logs()
+	if job.Output == nil || exitCode != 0 {
+		return result, nil
+	}
+
+	var file []byte
+	if job.Output.From == OutputFromFile {
+		reader, ok := executor.(FileReader)
+		if !ok {
+			return result, errors.Errorf("%s jobs can't take their output from a file", job.Type)
+		}
+		file, err = reader.ReadFile(ctx, job.Output.Path)
+		if err != nil {
+			return result, errors.Wrapf(err, "unable to copy output from %s", job.Output.Path)
+		}
+	}
+
+	result.Output, err = extractOutput(job.Output, capture.Stdout(), file)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// readLogs reads the output of a completed job into the capture.
+func readLogs(ctx context.Context, executor Executor, capture *Capture) error {
+	logs, err := executor.Logs(ctx)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	return capture.read(logs)
+}
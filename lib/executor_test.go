@@ -0,0 +1,416 @@
+package lib_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/palicao/docker-executor/lib"
+	"github.com/palicao/docker-executor/lib/dockerfake"
+	pkgerrors "github.com/pkg/errors"
+)
+
+func runJob(ctx context.Context, t *testing.T, client *dockerfake.Client, job lib.Job) (*lib.JobResult, error) {
+	executor, err := lib.NewExecutor(job.Type, lib.NewDockerApi(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib.RunJob(ctx, executor, job, lib.NewCapture(job, nil))
+}
+
+func containerJob() lib.Job {
+	return lib.Job{Type: lib.JobTypeRun, Image: "alpine", Tag: "latest", Cmd: []string{"true"}}
+}
+
+func serviceJob() lib.Job {
+	return lib.Job{Type: lib.JobTypeService, Image: "alpine", Tag: "latest", Mode: lib.ModeReplicated, Replicas: 1}
+}
+
+func TestContainerExitCode(t *testing.T) {
+	for _, exitCode := range []int64{0, 3} {
+		client := dockerfake.New()
+		client.SetBehavior("alpine", dockerfake.Behavior{ExitCode: exitCode, Stdout: "out\n", Stderr: "err\n"})
+
+		result, err := runJob(context.Background(), t, client, containerJob())
+		if err != nil {
+			t.Fatalf("exit code %d: %v", exitCode, err)
+		}
+		if result.ExitCode != exitCode {
+			t.Errorf("exit code %d: got %d", exitCode, result.ExitCode)
+		}
+		if string(result.Logs) != "out\nerr\n" {
+			t.Errorf("exit code %d: logs %q", exitCode, result.Logs)
+		}
+		for id, ctr := range client.Containers {
+			if !ctr.Started || !ctr.Removed {
+				t.Errorf("exit code %d: container %s started %t, removed %t", exitCode, id, ctr.Started, ctr.Removed)
+			}
+		}
+	}
+}
+
+func TestContainerPullsMissingImage(t *testing.T) {
+	client := dockerfake.New()
+	client.Images["busybox:latest"] = true
+
+	_, err := runJob(context.Background(), t, client, containerJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := containerJob()
+	job.Image = "busybox"
+	_, err = runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(client.Pulls, []string{"alpine:latest"}) {
+		t.Errorf("pulled %v", client.Pulls)
+	}
+}
+
+func TestContainerPullFailure(t *testing.T) {
+	client := dockerfake.New()
+	client.PullErrors["alpine:latest"] = errors.New("pull access denied")
+
+	result, err := runJob(context.Background(), t, client, containerJob())
+	if err == nil || !strings.Contains(err.Error(), "pull access denied") {
+		t.Fatalf("got %v", err)
+	}
+	if result != nil {
+		t.Errorf("got a result %+v", result)
+	}
+	if len(client.Containers) != 0 {
+		t.Errorf("created %d containers", len(client.Containers))
+	}
+}
+
+func TestContainerOutputFromFile(t *testing.T) {
+	client := dockerfake.New()
+	client.SetBehavior("alpine", dockerfake.Behavior{Stdout: "done\n", Files: map[string]string{"/out/result": "42\n"}})
+	job := containerJob()
+	job.Output = &lib.JobOutput{From: lib.OutputFromFile, Path: "/out/result"}
+
+	result, err := runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Output != "42" {
+		t.Errorf("output %#v", result.Output)
+	}
+
+	job.Output.Path = "/out/missing"
+	result, err = runJob(context.Background(), t, client, job)
+	if err == nil {
+		t.Fatal("no error for a missing file")
+	}
+	if result == nil || result.ExitCode != 0 || string(result.Logs) != "done\n" {
+		t.Errorf("result not kept along with the error: %+v", result)
+	}
+}
+
+// signalWriter signals its first write.
+type signalWriter struct {
+	once    sync.Once
+	written chan struct{}
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.written)
+	})
+	return len(p), nil
+}
+
+func TestContainerStreamsLogs(t *testing.T) {
+	client := dockerfake.New()
+	client.SetBehavior("alpine", dockerfake.Behavior{Delay: 500 * time.Millisecond, Stdout: "out\n"})
+	job := containerJob()
+	executor, err := lib.NewExecutor(job.Type, lib.NewDockerApi(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spill := &signalWriter{written: make(chan struct{})}
+
+	var result *lib.JobResult
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = lib.RunJob(context.Background(), executor, job, lib.NewCapture(job, spill))
+	}()
+	select {
+	case <-spill.written:
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("no output while the container runs")
+	}
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Logs) != "out\n" {
+		t.Errorf("logs %q", result.Logs)
+	}
+}
+
+func TestContainerTimeout(t *testing.T) {
+	client := dockerfake.New()
+	client.SetBehavior("alpine", dockerfake.Behavior{Delay: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := runJob(ctx, t, client, containerJob())
+	if pkgerrors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+	for id, ctr := range client.Containers {
+		if !ctr.Removed {
+			t.Errorf("container %s not removed", id)
+		}
+	}
+}
+
+func TestServiceTaskStates(t *testing.T) {
+	tests := []struct {
+		name          string
+		behavior      dockerfake.Behavior
+		replicas      int
+		minSuccessful int
+		exitCode      int64
+		states        []string
+	}{
+		{
+			name:     "complete",
+			behavior: dockerfake.Behavior{TaskStates: []swarm.TaskState{swarm.TaskStateRunning, swarm.TaskStateComplete}},
+			exitCode: 0,
+			states:   []string{"complete"},
+		},
+		{
+			name:     "rejected",
+			behavior: dockerfake.Behavior{TaskStates: []swarm.TaskState{swarm.TaskStatePending, swarm.TaskStateRejected}, TaskErr: "no such image"},
+			exitCode: 1,
+			states:   []string{"rejected"},
+		},
+		{
+			name:     "failed",
+			behavior: dockerfake.Behavior{ExitCode: 2, FailedTasks: 1},
+			replicas: 3,
+			exitCode: 2,
+			states:   []string{"failed", "complete", "complete"},
+		},
+		{
+			name:          "enough successful",
+			behavior:      dockerfake.Behavior{ExitCode: 2, FailedTasks: 1},
+			replicas:      3,
+			minSuccessful: 2,
+			exitCode:      0,
+			states:        []string{"failed", "complete", "complete"},
+		},
+		{
+			name:          "not enough successful",
+			behavior:      dockerfake.Behavior{ExitCode: 2, FailedTasks: 2},
+			replicas:      3,
+			minSuccessful: 2,
+			exitCode:      2,
+			states:        []string{"failed", "failed", "complete"},
+		},
+	}
+
+	for _, test := range tests {
+		client := dockerfake.New()
+		client.SetBehavior("alpine", test.behavior)
+		job := serviceJob()
+		if test.replicas > 0 {
+			job.Replicas = test.replicas
+		}
+		job.MinSuccessful = test.minSuccessful
+
+		result, err := runJob(context.Background(), t, client, job)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.ExitCode != test.exitCode {
+			t.Errorf("%s: exit code %d, want %d", test.name, result.ExitCode, test.exitCode)
+		}
+		var states []string
+		for _, task := range result.Tasks {
+			states = append(states, task.State)
+			if task.State == "rejected" && task.Error != test.behavior.TaskErr {
+				t.Errorf("%s: task error %q", test.name, task.Error)
+			}
+		}
+		if !reflect.DeepEqual(states, test.states) {
+			t.Errorf("%s: task states %v, want %v", test.name, states, test.states)
+		}
+		for id, service := range client.Services {
+			if !service.Removed {
+				t.Errorf("%s: service %s not removed", test.name, id)
+			}
+		}
+	}
+}
+
+func TestServiceTimeline(t *testing.T) {
+	client := dockerfake.New()
+	client.SetBehavior("alpine", dockerfake.Behavior{TaskStates: []swarm.TaskState{swarm.TaskStatePending, swarm.TaskStateRunning, swarm.TaskStateComplete}})
+	client.EventsErr = errors.New("events not supported")
+
+	result, err := runJob(context.Background(), t, client, serviceJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Tasks) != 1 {
+		t.Fatalf("got %d tasks", len(result.Tasks))
+	}
+	var states []string
+	for _, transition := range result.Tasks[0].Timeline {
+		states = append(states, transition.State)
+	}
+	if !reflect.DeepEqual(states, []string{"pending", "running", "complete"}) {
+		t.Errorf("timeline %v", states)
+	}
+}
+
+func TestServiceCancel(t *testing.T) {
+	client := dockerfake.New()
+	client.SetBehavior("alpine", dockerfake.Behavior{Delay: time.Hour, TaskStates: []swarm.TaskState{swarm.TaskStateRunning}})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	result, err := runJob(ctx, t, client, serviceJob())
+	if pkgerrors.Cause(err) != context.Canceled {
+		t.Fatalf("got %v", err)
+	}
+	if result == nil || len(result.Tasks) != 1 || result.Tasks[0].State != "running" {
+		t.Errorf("tasks not recorded: %+v", result)
+	}
+	for id, service := range client.Services {
+		if !service.Removed {
+			t.Errorf("service %s not removed", id)
+		}
+	}
+}
+
+func TestServiceLogLabels(t *testing.T) {
+	client := dockerfake.New()
+	client.Nodes = []string{"node1", "node2"}
+	client.Hostnames = map[string]string{"node1": "alpha", "node2": "beta"}
+	client.SetBehavior("alpine", dockerfake.Behavior{Stdout: "out\n", Stderr: "err\n"})
+
+	job := serviceJob()
+	job.Replicas = 2
+	result, err := runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1@alpha | out\n1@alpha | err\n2@beta | out\n2@beta | err\n"
+	if string(result.Logs) != want {
+		t.Errorf("replicated logs %q, want %q", result.Logs, want)
+	}
+
+	job.Mode, job.Replicas = lib.ModeGlobal, 0
+	result, err = runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "alpha | out\nalpha | err\nbeta | out\nbeta | err\n"
+	if string(result.Logs) != want {
+		t.Errorf("global logs %q, want %q", result.Logs, want)
+	}
+
+	client.Nodes = []string{"node1"}
+	job.Mode, job.Replicas = lib.ModeReplicated, 1
+	result, err = runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Logs) != "out\nerr\n" {
+		t.Errorf("single task logs %q", result.Logs)
+	}
+}
+
+func TestServiceGlobal(t *testing.T) {
+	client := dockerfake.New()
+	client.Nodes = []string{"node1", "node2", "node3"}
+	client.SetBehavior("alpine", dockerfake.Behavior{ExitCode: 1, FailedTasks: 1})
+	job := serviceJob()
+	job.Mode, job.Replicas, job.MinSuccessful = lib.ModeGlobal, 0, 2
+
+	result, err := runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 0 || len(result.Tasks) != 3 {
+		t.Errorf("exit code %d with %d tasks", result.ExitCode, len(result.Tasks))
+	}
+	for _, service := range client.Services {
+		if service.Spec.Mode.GlobalJob == nil {
+			t.Errorf("mode %+v", service.Spec.Mode)
+		}
+	}
+
+	job.MinSuccessful = 3
+	result, err = runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 1 {
+		t.Errorf("exit code %d with a task failed out of 3", result.ExitCode)
+	}
+
+	job.Constraints = []string{"node.labels.cache==true"}
+	_, err = runJob(context.Background(), t, client, job)
+	if err == nil || !strings.Contains(err.Error(), "no node is eligible") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestServiceWithoutJobModes(t *testing.T) {
+	client := dockerfake.New()
+	client.APIVersion = "1.40"
+	job := serviceJob()
+	job.Replicas = 2
+
+	result, err := runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 0 {
+		t.Errorf("exit code %d", result.ExitCode)
+	}
+	for _, service := range client.Services {
+		mode := service.Spec.Mode
+		if mode.ReplicatedJob != nil || mode.Replicated == nil || *mode.Replicated.Replicas != 2 {
+			t.Errorf("mode %+v", mode)
+		}
+		if service.Spec.TaskTemplate.RestartPolicy.Condition != swarm.RestartPolicyConditionNone {
+			t.Errorf("restart policy %+v", service.Spec.TaskTemplate.RestartPolicy)
+		}
+	}
+}
+
+func TestServiceRemoteTasks(t *testing.T) {
+	client := dockerfake.New()
+	client.Nodes = []string{"node1", "node2"}
+	client.SetBehavior("alpine", dockerfake.Behavior{TaskStates: []swarm.TaskState{swarm.TaskStateRunning, swarm.TaskStateRunning, swarm.TaskStateComplete}})
+	job := serviceJob()
+	job.Replicas = 2
+
+	start := time.Now()
+	result, err := runJob(context.Background(), t, client, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 0 {
+		t.Errorf("exit code %d", result.ExitCode)
+	}
+	// the task of node2 exits unseen by the events of node1, so it is polled
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s", elapsed)
+	}
+}
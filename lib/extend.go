@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"path/filepath"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// mergeJob returns a job with the settings it leaves unset taken from base:
+// those it has no key for, or, when the keys it has are not known, those
+// with the zero value. Lists are appended to the ones of base, except cmd
+// which replaces it, and env which overrides the variables of base by key.
+// Maps are merged, the job winning over base.
+func mergeJob(base Job, job Job) Job {
+	merged := job
+	dst := reflect.ValueOf(&merged).Elem()
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlKey(t.Field(i))
+		if name == "" {
+			continue
+		}
+		field := dst.Field(i)
+		switch field.Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Map:
+			mergeValue(field, reflect.ValueOf(base).Field(i), name)
+		default:
+			if !job.set[name] && isZero(field) {
+				field.Set(reflect.ValueOf(base).Field(i))
+			}
+		}
+	}
+	if len(base.set) > 0 || len(job.set) > 0 {
+		merged.set = make(map[string]bool, len(base.set)+len(job.set))
+		for name := range base.set {
+			merged.set[name] = true
+		}
+		for name := range job.set {
+			merged.set[name] = true
+		}
+	}
+	return merged
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func mergeValue(dst reflect.Value, base reflect.Value, key string) {
+	switch dst.Kind() {
+	case reflect.Struct:
+		t := dst.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := yamlKey(t.Field(i))
+			if name == "" {
+				continue
+			}
+			mergeValue(dst.Field(i), base.Field(i), name)
+		}
+	case reflect.Slice:
+		if base.Len() == 0 {
+			return
+		}
+		switch key {
+		case "cmd":
+			if dst.Len() == 0 {
+				dst.Set(base)
+			}
+		case "env":
+			env := mergeEnv(base.Convert(reflect.TypeOf([]string{})).Interface().([]string), dst.Convert(reflect.TypeOf([]string{})).Interface().([]string))
+			dst.Set(reflect.ValueOf(env).Convert(dst.Type()))
+		default:
+			merged := reflect.MakeSlice(dst.Type(), 0, base.Len()+dst.Len())
+			merged = reflect.AppendSlice(reflect.AppendSlice(merged, base), dst)
+			dst.Set(merged)
+		}
+	case reflect.Map:
+		if base.Len() == 0 {
+			return
+		}
+		merged := reflect.MakeMap(dst.Type())
+		for _, k := range base.MapKeys() {
+			merged.SetMapIndex(k, base.MapIndex(k))
+		}
+		for _, k := range dst.MapKeys() {
+			merged.SetMapIndex(k, dst.MapIndex(k))
+		}
+		dst.Set(merged)
+	default:
+		if isZero(dst) {
+			dst.Set(base)
+		}
+	}
+}
+
+// extendJob applies to a job the templates it extends, each template possibly
+// extending another one, and the defaults.
+func extendJob(job Job, config *Config) (Job, error) {
+	seen := map[string]bool{}
+	for current := job; current.Extends != ""; {
+		name := current.Extends
+		template, ok := config.Templates[name]
+		if !ok {
+			return job, fieldError{field: "extends", err: errors.Errorf("extends unknown template %s", name)}
+		}
+		if seen[name] {
+			return job, fieldError{field: "extends", err: errors.Errorf("template %s extends itself", name)}
+		}
+		seen[name] = true
+		job = mergeJob(template, job)
+		current = template
+	}
+	if config.Defaults != nil {
+		job = mergeJob(*config.Defaults, job)
+	}
+	job.Extends = ""
+	return job, nil
+}
+
+// absEnvFiles makes the env files of a template or defaults relative to the
+// file declaring them, rather than to the files of the jobs using them.
+func absEnvFiles(job Job, source string) Job {
+	envFiles := make([]string, len(job.EnvFile))
+	for i, filename := range job.EnvFile {
+		envFiles[i] = filename
+		if !filepath.IsAbs(filename) {
+			envFiles[i] = filepath.Join(filepath.Dir(source), filename)
+		}
+	}
+	job.EnvFile = envFiles
+	return job
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeJob(t *testing.T) {
+	tests := []struct {
+		name string
+		base Job
+		job  Job
+		want Job
+	}{
+		{
+			name: "unset settings",
+			base: Job{Image: "alpine", Tag: "3", Timeout: time.Minute, Output: &JobOutput{Path: "/out"}},
+			job:  Job{Image: "busybox"},
+			want: Job{Image: "busybox", Tag: "3", Timeout: time.Minute, Output: &JobOutput{Path: "/out"}},
+		},
+		{
+			name: "cmd replaces",
+			base: Job{Cmd: []string{"backup", "--all"}},
+			job:  Job{Cmd: []string{"restore"}},
+			want: Job{Cmd: []string{"restore"}},
+		},
+		{
+			name: "cmd inherited",
+			base: Job{Cmd: []string{"backup", "--all"}},
+			job:  Job{},
+			want: Job{Cmd: []string{"backup", "--all"}},
+		},
+		{
+			name: "env merges by key",
+			base: Job{Env: EnvList{"A=1", "B=2"}},
+			job:  Job{Env: EnvList{"C=3", "A=10"}},
+			want: Job{Env: EnvList{"A=10", "B=2", "C=3"}},
+		},
+		{
+			name: "lists append",
+			base: Job{Secrets: []string{"db"}, Constraints: []string{"node.role==worker"}},
+			job:  Job{Secrets: []string{"api"}},
+			want: Job{Secrets: []string{"db", "api"}, Constraints: []string{"node.role==worker"}},
+		},
+		{
+			name: "nested lists append",
+			base: Job{Notifications: Notifications{Webhooks: []Webhook{{Url: "http://ops"}}}},
+			job:  Job{Notifications: Notifications{Webhooks: []Webhook{{Url: "http://dev"}}, Emails: []Email{{To: []string{"dev@example.com"}}}}},
+			want: Job{Notifications: Notifications{Webhooks: []Webhook{{Url: "http://ops"}, {Url: "http://dev"}}, Emails: []Email{{To: []string{"dev@example.com"}}}}},
+		},
+		{
+			name: "zero values without keys",
+			base: Job{ApiExpose: true, Replicas: 3},
+			job:  Job{},
+			want: Job{ApiExpose: true, Replicas: 3},
+		},
+		{
+			name: "explicit zero values",
+			base: Job{ApiExpose: true, Replicas: 3, Image: "alpine", Suspended: true},
+			job:  Job{Suspended: false, set: map[string]bool{"api_expose": true, "replicas": true, "suspended": true}},
+			want: Job{Image: "alpine", set: map[string]bool{"api_expose": true, "replicas": true, "suspended": true}},
+		},
+		{
+			name: "keys of both",
+			base: Job{set: map[string]bool{"image": true}},
+			job:  Job{set: map[string]bool{"api_expose": true}},
+			want: Job{set: map[string]bool{"image": true, "api_expose": true}},
+		},
+	}
+	for _, test := range tests {
+		got := mergeJob(test.base, test.job)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: merged %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	base := Webhook{Url: "http://ops", Headers: map[string]string{"A": "1", "B": "2"}}
+	webhook := Webhook{Headers: map[string]string{"B": "20", "C": "3"}}
+	mergeValue(reflect.ValueOf(&webhook).Elem(), reflect.ValueOf(base), "")
+	want := Webhook{Url: "http://ops", Headers: map[string]string{"A": "1", "B": "20", "C": "3"}}
+	if !reflect.DeepEqual(webhook, want) {
+		t.Errorf("merged %+v, want %+v", webhook, want)
+	}
+}
+
+func TestExtendJob(t *testing.T) {
+	config := &Config{
+		Defaults: &Job{Image: "alpine", ApiExpose: true, Env: EnvList{"LEVEL=defaults", "A=1"}},
+		Templates: map[string]Job{
+			"base":    {Tag: "3", Env: EnvList{"LEVEL=base", "B=2"}, Secrets: []string{"db"}},
+			"backup":  {Extends: "base", Cmd: []string{"backup"}, Env: EnvList{"LEVEL=backup"}, Secrets: []string{"s3"}},
+			"private": {Extends: "backup", ApiExpose: false, set: map[string]bool{"api_expose": true}},
+			"loop":    {Extends: "cycle"},
+			"cycle":   {Extends: "loop"},
+		},
+	}
+
+	job, err := extendJob(Job{Name: "nightly", Extends: "backup", Env: EnvList{"C=3"}, Secrets: []string{"ftp"}}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Job{
+		Name:      "nightly",
+		Image:     "alpine",
+		Tag:       "3",
+		ApiExpose: true,
+		Cmd:       []string{"backup"},
+		Env:       EnvList{"LEVEL=backup", "A=1", "B=2", "C=3"},
+		Secrets:   []string{"db", "s3", "ftp"},
+	}
+	if !reflect.DeepEqual(job, want) {
+		t.Errorf("extended %+v, want %+v", job, want)
+	}
+
+	job, err = extendJob(Job{Name: "hidden", Extends: "private"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ApiExpose || job.Tag != "3" {
+		t.Errorf("extended %+v, want api_expose false from the template", job)
+	}
+
+	for name, message := range map[string]string{
+		"loop":    "template loop extends itself",
+		"missing": "extends unknown template missing",
+	} {
+		_, err = extendJob(Job{Name: "broken", Extends: name}, config)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("extending %s: error %v, want %q", name, err, message)
+		}
+	}
+}
+
+func TestExplicitZeroOverridesDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	content := `defaults:
+  image: alpine
+  api_expose: true
+  replicas: 3
+jobs:
+  exposed:
+    type: service
+    schedule: '@daily'
+  hidden:
+    type: service
+    schedule: '@daily'
+    api_expose: false
+`
+	err = ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := GetConfigFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Jobs["exposed"].ApiExpose {
+		t.Error("exposed job not exposed by the defaults")
+	}
+	if config.Jobs["hidden"].ApiExpose {
+		t.Error("hidden job exposed by the defaults")
+	}
+	if config.Jobs["hidden"].Replicas != 3 {
+		t.Errorf("hidden job has %d replicas, want 3", config.Jobs["hidden"].Replicas)
+	}
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FormatYaml = "yaml"
+	FormatJson = "json"
+	FormatToml = "toml"
+)
+
+// configExtensions are the extensions of the config files loaded from a
+// directory.
+var configExtensions = []string{".yaml", ".yml", ".json", ".toml"}
+
+// ConfigFormat returns the format of a config file, given by its extension,
+// yaml by default.
+func ConfigFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return FormatJson
+	case ".toml":
+		return FormatToml
+	}
+	return FormatYaml
+}
+
+var tomlLineRegexp = regexp.MustCompile(`^Near line (\d+) \(last key parsed '[^']*'\): (.*)$`)
+
+// decodeConfig decodes a config file in any format, returning the position
+// of its keys. Json is decoded as the yaml it is a subset of, while toml is
+// converted to yaml, its type errors being moved back to the toml keys they
+// are about. Syntax errors are returned as err, type errors as errs, the
+// config being decoded anyway.
+func decodeConfig(filename string, content []byte) (config *Config, keys []keyPosition, errs ConfigErrors, err error) {
+	switch ConfigFormat(filename) {
+	case FormatJson:
+		var v interface{}
+		err = json.Unmarshal(content, &v)
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(content[:syntaxErr.Offset], []byte("\n")) + 1
+			column := int(syntaxErr.Offset) - bytes.LastIndexByte(content[:syntaxErr.Offset], '\n') - 1
+			return nil, nil, nil, ConfigErrors{{File: filename, Line: line, Column: column, Message: err.Error()}}
+		}
+		if err != nil {
+			return nil, nil, nil, ConfigErrors{{File: filename, Message: err.Error()}}
+		}
+		keys = locateJsonKeys(content)
+	case FormatToml:
+		keys = locateTomlKeys(content)
+		var v map[string]interface{}
+		_, err = toml.Decode(string(content), &v)
+		if err != nil {
+			configErr := ConfigError{File: filename, Message: err.Error()}
+			if match := tomlLineRegexp.FindStringSubmatch(err.Error()); match != nil {
+				configErr.Line, _ = strconv.Atoi(match[1])
+				configErr.Message = match[2]
+			}
+			return nil, nil, nil, ConfigErrors{configErr}
+		}
+		content, err = yaml.Marshal(v)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	default:
+		keys = locateKeys(content)
+	}
+
+	err = yaml.Unmarshal(content, &config)
+	if _, ok := err.(*yaml.TypeError); ok {
+		errs = yamlErrors(filename, err)
+		err = nil
+	} else if err != nil {
+		return nil, nil, nil, yamlErrors(filename, err)
+	}
+	if ConfigFormat(filename) == FormatToml {
+		errs = relocate(errs, locateKeys(content), keys)
+	}
+	errs = locateColumns(errs, keys)
+	if config == nil {
+		config = &Config{}
+	}
+	return config, keys, errs, nil
+}
+
+// relocate moves errors located in a converted document to the position of
+// the same key in the original one.
+func relocate(errs ConfigErrors, converted []keyPosition, original []keyPosition) ConfigErrors {
+	for i := range errs {
+		line := errs[i].Line
+		errs[i].Line, errs[i].Column = 0, 0
+		for _, k := range converted {
+			if k.line != line {
+				continue
+			}
+			if position := locate(original, k.path); position != nil {
+				errs[i].Line, errs[i].Column = position.line, position.column
+			}
+			break
+		}
+	}
+	return errs
+}
+
+// locateColumns gives the errors located at a line only, as the type errors
+// of the yaml decoder are, the column of the first key of the line.
+func locateColumns(errs ConfigErrors, keys []keyPosition) ConfigErrors {
+	for i := range errs {
+		if errs[i].Line == 0 || errs[i].Column > 0 {
+			continue
+		}
+		for _, k := range keys {
+			if k.line == errs[i].Line {
+				errs[i].Column = k.column
+				break
+			}
+		}
+	}
+	return errs
+}
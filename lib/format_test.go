@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the same config in every format, with replicas of the wrong type and a
+	// misspelled key, both on line 4
+	files := map[string]string{
+		"config.yml": `jobs:
+  backup:
+    image: alpine
+    replicas: many
+    shedule: '@daily'
+`,
+		"config.json": `{"jobs": {
+  "backup": {
+    "image": "alpine",
+    "replicas": "many", "shedule": "@daily"
+  }
+}}
+`,
+		"config.toml": `[jobs.backup]
+image = "alpine"
+
+replicas = "many"
+shedule = "@daily"
+`,
+	}
+	positions := map[string][][2]int{
+		"config.yml":  {{4, 5}, {5, 5}},
+		"config.json": {{4, 5}, {4, 25}},
+		"config.toml": {{4, 1}, {5, 1}},
+	}
+	var messages []string
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		err := ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, errs, err := readConfigFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if file.config.Jobs["backup"].Image != "alpine" {
+			t.Errorf("%s: decoded %+v", name, file.config.Jobs["backup"])
+		}
+		if len(errs) != 2 {
+			t.Errorf("%s: errors %v", name, errs)
+			continue
+		}
+		for i, configErr := range errs {
+			if configErr.File != filename || configErr.Line != positions[name][i][0] || configErr.Column != positions[name][i][1] {
+				t.Errorf("%s: error %d at %s:%d:%d, want %v", name, i, configErr.File, configErr.Line, configErr.Column, positions[name][i])
+			}
+		}
+		if messages == nil {
+			messages = []string{errs[0].Message, errs[1].Message}
+		} else if !reflect.DeepEqual([]string{errs[0].Message, errs[1].Message}, messages) {
+			t.Errorf("%s: errors %q, want %q", name, []string{errs[0].Message, errs[1].Message}, messages)
+		}
+	}
+	if messages != nil && messages[1] != "unknown key shedule" {
+		t.Errorf("errors %q", messages)
+	}
+}
+
+func TestDecodeSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  string
+		line     int
+	}{
+		{"config.yml", "jobs:\n  backup:\n    image: [alpine\n", 3},
+		{"config.json", "{\"jobs\": {\n  \"backup\": {\"image\" \"alpine\"}\n}}", 2},
+		{"config.toml", "[jobs.backup]\nimage = alpine\n", 2},
+	}
+	for _, test := range tests {
+		_, _, _, err := decodeConfig(test.filename, []byte(test.content))
+		errs, ok := err.(ConfigErrors)
+		if !ok || len(errs) != 1 || errs[0].File != test.filename || errs[0].Line != test.line {
+			t.Errorf("%s: error %#v, want one on line %d", test.filename, err, test.line)
+		}
+	}
+}
+
+func TestSchemaJobTypes(t *testing.T) {
+	RegisterExecutor("batch", newContainerExecutor)
+	defer delete(executors, "batch")
+
+	schema := JsonSchema()
+	job := schema["definitions"].(map[string]interface{})["Job"].(map[string]interface{})
+	jobType := job["properties"].(map[string]interface{})["type"].(map[string]interface{})
+	if !reflect.DeepEqual(jobType["enum"], JobTypes()) {
+		t.Errorf("type enum %v, want %v", jobType["enum"], JobTypes())
+	}
+	if !reflect.DeepEqual(jobType["enum"], []string{"batch", JobTypeRun, JobTypeService}) {
+		t.Errorf("type enum %v", jobType["enum"])
+	}
+
+	catchup := job["properties"].(map[string]interface{})["catchup"].(map[string]interface{})
+	if !reflect.DeepEqual(catchup["enum"], schemaEnums["Job.catchup"]) {
+		t.Errorf("catchup enum %v", catchup["enum"])
+	}
+}
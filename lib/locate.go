@@ -0,0 +1,368 @@
+package lib
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// keyPosition is where a key of a config file is, given by its path from
+// the root, sequence items being numbered from 0.
+type keyPosition struct {
+	path   []string
+	line   int
+	column int
+}
+
+var yamlKeyRegexp = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'(?:[^']|'')*'|[^\s#'"{\[\]},:&*!|>%@` + "`" + `-][^:#]*?|-[^\s:#][^:#]*?)\s*:(\s|$)`)
+
+// locateKeys returns the position of every key of the block mappings of a
+// yaml document, in the order they appear. It only understands the block
+// style used by config files: keys inside flow collections are not located.
+func locateKeys(in []byte) []keyPosition {
+	type frame struct {
+		indent int
+		key    string
+		seq    bool
+		items  int
+	}
+	var stack []*frame
+	var keys []keyPosition
+	blockIndent := -1
+
+	path := func() []string {
+		p := make([]string, len(stack))
+		for i, f := range stack {
+			p[i] = f.key
+		}
+		return p
+	}
+
+	for n, line := range strings.Split(string(in), "\n") {
+		content := strings.TrimLeft(line, " ")
+		column := len(line) - len(content)
+		content = strings.TrimRight(content, " \r")
+
+		if blockIndent >= 0 {
+			if content == "" || column > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" || content == "..." {
+			continue
+		}
+
+		for content == "-" || strings.HasPrefix(content, "- ") {
+			for len(stack) > 0 && (stack[len(stack)-1].indent > column || (stack[len(stack)-1].indent == column && stack[len(stack)-1].seq)) {
+				stack = stack[:len(stack)-1]
+			}
+			index := 0
+			if len(stack) > 0 {
+				index = stack[len(stack)-1].items
+				stack[len(stack)-1].items++
+			}
+			stack = append(stack, &frame{indent: column, key: strconv.Itoa(index), seq: true})
+			rest := strings.TrimLeft(content[1:], " ")
+			column += len(content) - len(rest)
+			content = rest
+		}
+
+		if len(stack) > 0 && stack[len(stack)-1].seq && (strings.HasPrefix(content, "|") || strings.HasPrefix(content, ">")) {
+			blockIndent = stack[len(stack)-1].indent
+			continue
+		}
+		match := yamlKeyRegexp.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		key := strings.TrimSpace(match[1])
+		if unquoted, err := strconv.Unquote(key); err == nil && strings.HasPrefix(key, `"`) {
+			key = unquoted
+		} else if strings.HasPrefix(key, "'") {
+			key = strings.Replace(key[1:len(key)-1], "''", "'", -1)
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= column {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, &frame{indent: column, key: key})
+		keys = append(keys, keyPosition{path: path(), line: n + 1, column: column + 1})
+
+		value := strings.TrimSpace(content[len(match[0]):])
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = column
+		}
+	}
+	return keys
+}
+
+// locate returns the position of the deepest located key along a path, or
+// nil if none is.
+func locate(keys []keyPosition, path []string) *keyPosition {
+	var found *keyPosition
+	depth := 0
+	for i := range keys {
+		k := &keys[i]
+		if len(k.path) <= depth || len(k.path) > len(path) {
+			continue
+		}
+		match := true
+		for j := range k.path {
+			if k.path[j] != path[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			found, depth = k, len(k.path)
+		}
+	}
+	return found
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// yamlKey returns the key of the value of a struct field in the config, or
+// nothing when it has none.
+func yamlKey(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// fieldType returns the type of the value of a key within a value of type t,
+// and whether the key is allowed.
+func fieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if yamlKey(f) == key {
+				return f.Type, true
+			}
+		}
+		return nil, false
+	case reflect.Map:
+		return t.Elem(), true
+	case reflect.Slice, reflect.Array:
+		_, err := strconv.Atoi(key)
+		return t.Elem(), err == nil
+	case reflect.Interface:
+		return t, true
+	}
+	return nil, false
+}
+
+// unknownKeys returns the located keys which are not fields of a value of
+// type t, such as misspelled ones. The content of values decoding themselves
+// is not checked.
+func unknownKeys(keys []keyPosition, t reflect.Type) []keyPosition {
+	var unknown []keyPosition
+	for _, k := range keys {
+		current := t
+		for i, key := range k.path {
+			if current.Implements(unmarshalerType) || reflect.PtrTo(current).Implements(unmarshalerType) {
+				break
+			}
+			next, ok := fieldType(current, key)
+			if !ok {
+				if i == len(k.path)-1 {
+					unknown = append(unknown, k)
+				}
+				break
+			}
+			current = next
+		}
+	}
+	return unknown
+}
+
+// duplicateKeys returns the located keys appearing more than once within the
+// same mapping. The keys nested under a duplicate are not reported, the
+// duplicate itself being.
+func duplicateKeys(keys []keyPosition) []keyPosition {
+	var duplicates []keyPosition
+	var duplicate []string
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if duplicate != nil && nestedUnder(k.path, duplicate) {
+			continue
+		}
+		duplicate = nil
+		p := strings.Join(k.path, "\x00")
+		if seen[p] {
+			duplicates = append(duplicates, k)
+			duplicate = k.path
+		}
+		seen[p] = true
+	}
+	return duplicates
+}
+
+// nestedUnder tells whether a key path is nested under another.
+func nestedUnder(path []string, parent []string) bool {
+	if len(path) <= len(parent) {
+		return false
+	}
+	for i := range parent {
+		if path[i] != parent[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// locateJsonKeys returns the position of every key of the objects of a json
+// document, in the order they appear.
+func locateJsonKeys(in []byte) []keyPosition {
+	type frame struct {
+		object  bool
+		segment string
+		key     string
+		items   int
+	}
+	var stack []*frame
+	var keys []keyPosition
+	line, column := 1, 1
+	expectKey := false
+
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		switch c {
+		case '\n':
+			line, column = line+1, 1
+			continue
+		case '{', '[':
+			segment := ""
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				segment = parent.key
+				if !parent.object {
+					segment = strconv.Itoa(parent.items)
+				}
+			}
+			stack = append(stack, &frame{object: c == '{', segment: segment})
+			expectKey = c == '{'
+		case '}', ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case ',':
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				expectKey = top.object
+				if !top.object {
+					top.items++
+				}
+			}
+		case '"':
+			start, startColumn := i+1, column
+			for i++; i < len(in) && in[i] != '"'; i++ {
+				if in[i] == '\\' {
+					i++
+				}
+			}
+			column += i - start + 1
+			if expectKey && len(stack) > 0 {
+				key, err := strconv.Unquote(string(in[start-1 : i+1]))
+				if err != nil {
+					key = string(in[start:i])
+				}
+				stack[len(stack)-1].key = key
+				path := []string{}
+				for _, f := range stack[1:] {
+					path = append(path, f.segment)
+				}
+				keys = append(keys, keyPosition{path: append(path, key), line: line, column: startColumn})
+				expectKey = false
+			}
+		}
+		column++
+	}
+	return keys
+}
+
+var (
+	tomlTableRegexp = regexp.MustCompile(`^(\[\[?)\s*([^\]]+?)\s*\]\]?`)
+	tomlKeyRegexp   = regexp.MustCompile(`^((?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*')(?:\s*\.\s*(?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*'))*)\s*=`)
+	tomlPartRegexp  = regexp.MustCompile(`[A-Za-z0-9_-]+|"[^"]*"|'[^']*'`)
+)
+
+// tomlKeyPath splits a dotted toml key into its parts.
+func tomlKeyPath(key string) []string {
+	var path []string
+	for _, part := range tomlPartRegexp.FindAllString(key, -1) {
+		if unquoted, err := strconv.Unquote(part); err == nil && strings.HasPrefix(part, `"`) {
+			part = unquoted
+		} else if strings.HasPrefix(part, "'") {
+			part = part[1 : len(part)-1]
+		}
+		path = append(path, part)
+	}
+	return path
+}
+
+// locateTomlKeys returns the position of every table and key of a toml
+// document, in the order they appear. Keys inside inline tables are not
+// located.
+func locateTomlKeys(in []byte) []keyPosition {
+	var keys []keyPosition
+	var table []string
+	arrays := map[string]int{}
+	multiline := ""
+
+	for n, line := range strings.Split(string(in), "\n") {
+		content := strings.TrimLeft(line, " \t")
+		column := len(line) - len(content) + 1
+		if multiline != "" {
+			if strings.Count(content, multiline)%2 == 1 {
+				multiline = ""
+			}
+			continue
+		}
+		if content == "" || strings.HasPrefix(content, "#") {
+			continue
+		}
+
+		if match := tomlTableRegexp.FindStringSubmatch(content); match != nil {
+			table = tomlKeyPath(match[2])
+			if match[1] == "[[" {
+				name := strings.Join(table, "\x00")
+				table = append(table, strconv.Itoa(arrays[name]))
+				arrays[name]++
+			}
+			keys = append(keys, keyPosition{path: table, line: n + 1, column: column})
+			continue
+		}
+
+		match := tomlKeyRegexp.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		path := append(append([]string{}, table...), tomlKeyPath(match[1])...)
+		keys = append(keys, keyPosition{path: path, line: n + 1, column: column})
+
+		value := content[len(match[0]):]
+		for _, quotes := range []string{`"""`, `'''`} {
+			if strings.Count(value, quotes)%2 == 1 {
+				multiline = quotes
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// positions formats located keys as "path@line:column" for comparison.
+func positions(keys []keyPosition) []string {
+	p := []string{}
+	for _, k := range keys {
+		p = append(p, fmt.Sprintf("%s@%d:%d", strings.Join(k.path, "."), k.line, k.column))
+	}
+	return p
+}
+
+func TestLocateKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "block mappings",
+			in:   "timezone: UTC\njobs:\n  backup:\n    image: alpine\n",
+			want: []string{"timezone@1:1", "jobs@2:1", "jobs.backup@3:3", "jobs.backup.image@4:5"},
+		},
+		{
+			name: "sequences",
+			in:   "jobs:\n  backup:\n    sinks:\n      - type: http\n        url: x\n      - type: file\n",
+			want: []string{"jobs@1:1", "jobs.backup@2:3", "jobs.backup.sinks@3:5", "jobs.backup.sinks.0.type@4:9", "jobs.backup.sinks.0.url@5:9", "jobs.backup.sinks.1.type@6:9"},
+		},
+		{
+			name: "block scalars",
+			in:   "jobs:\n  backup:\n    cmd:\n      - |\n        image: not a key\n\n        tag: neither\n    tag: latest\n  other: >\n    schedule: no\n",
+			want: []string{"jobs@1:1", "jobs.backup@2:3", "jobs.backup.cmd@3:5", "jobs.backup.tag@8:5", "jobs.other@9:3"},
+		},
+		{
+			name: "quoted keys",
+			in:   "jobs:\n  \"back:up\":\n    image: alpine\n  'it''s': {}\n  \"say \\\"hi\\\"\": {}\n",
+			want: []string{"jobs@1:1", "jobs.back:up@2:3", "jobs.back:up.image@3:5", "jobs.it's@4:3", "jobs.say \"hi\"@5:3"},
+		},
+		{
+			name: "flow maps",
+			in:   "jobs:\n  backup: {image: alpine, tag: latest}\n  restore:\n    env: {A: 1}\n    cmd: [a, 'b: c']\n",
+			want: []string{"jobs@1:1", "jobs.backup@2:3", "jobs.restore@3:3", "jobs.restore.env@4:5", "jobs.restore.cmd@5:5"},
+		},
+		{
+			name: "comments and documents",
+			in:   "---\n# jobs: no\njobs: # yes\n  backup:\n    image: alpine # image: no\n...\n",
+			want: []string{"jobs@3:1", "jobs.backup@4:3", "jobs.backup.image@5:5"},
+		},
+	}
+	for _, test := range tests {
+		got := positions(locateKeys([]byte(test.in)))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: located %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLocateJsonKeys(t *testing.T) {
+	in := `{
+  "timezone": "UTC",
+  "jobs": {
+    "back\"up": {"image": "alpine", "cmd": ["a", "b: c"]},
+    "restore": {
+      "sinks": [{"type": "http"}, {"type": "file"}]
+    }
+  }
+}`
+	want := []string{
+		"timezone@2:3", "jobs@3:3", "jobs.back\"up@4:5", "jobs.back\"up.image@4:18", "jobs.back\"up.cmd@4:37",
+		"jobs.restore@5:5", "jobs.restore.sinks@6:7", "jobs.restore.sinks.0.type@6:18", "jobs.restore.sinks.1.type@6:36",
+	}
+	got := positions(locateJsonKeys([]byte(in)))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("located %v, want %v", got, want)
+	}
+}
+
+func TestLocateTomlKeys(t *testing.T) {
+	in := `timezone = "UTC"
+[jobs.backup]
+image = "alpine"
+cmd = """
+tag = "not a key"
+"""
+notifications.emails = []
+[jobs."re.store"]
+  env = { A = "1" }
+[[jobs.backup.sinks]]
+type = "http"
+[[jobs.backup.sinks]]
+type = "file"
+`
+	want := []string{
+		"timezone@1:1", "jobs.backup@2:1", "jobs.backup.image@3:1", "jobs.backup.cmd@4:1", "jobs.backup.notifications.emails@7:1",
+		"jobs.re.store@8:1", "jobs.re.store.env@9:3",
+		"jobs.backup.sinks.0@10:1", "jobs.backup.sinks.0.type@11:1", "jobs.backup.sinks.1@12:1", "jobs.backup.sinks.1.type@13:1",
+	}
+	got := positions(locateTomlKeys([]byte(in)))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("located %v, want %v", got, want)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"known", "jobs:\n  backup:\n    schedule: '@daily'\n    env:\n      ANYTHING: 1\n", []string{}},
+		{"misspelled", "jobs:\n  backup:\n    shedule: '@daily'\n", []string{"jobs.backup.shedule@3:5"}},
+		{"top level", "timezone: UTC\njob:\n  backup:\n    image: alpine\n", []string{"job@2:1"}},
+		{"in a sequence", "sinks:\n  - type: http\n    uri: x\n", []string{"sinks.0.uri@3:5"}},
+		{"in templates", "templates:\n  base:\n    imag: alpine\n", []string{"templates.base.imag@3:5"}},
+	}
+	for _, test := range tests {
+		got := positions(unknownKeys(locateKeys([]byte(test.in)), reflect.TypeOf(Config{})))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: unknown %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"none", "jobs:\n  backup:\n    image: alpine\n  restore:\n    image: alpine\n", []string{}},
+		{"job name", "jobs:\n  backup:\n    image: alpine\n  backup:\n    image: busybox\n", []string{"jobs.backup@4:3"}},
+		{"field", "jobs:\n  backup:\n    image: alpine\n    tag: 1\n    image: busybox\n", []string{"jobs.backup.image@5:5"}},
+		{"sequence items", "sinks:\n  - type: http\n  - type: http\n", []string{}},
+	}
+	for _, test := range tests {
+		got := positions(duplicateKeys(locateKeys([]byte(test.in))))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: duplicates %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConfigErrorsLocated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	content := `jobs:
+  restore:
+    image: alpine
+    schedule: '@daily'
+  backup:
+    image: alpine
+    shedule: '@daily'
+  restore:
+    image: busybox
+    schedule: '@daily'
+`
+	err = ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, errs, err := readConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Stable(errs)
+	want := []string{
+		filename + ":7:5: configuration for job backup not valid: unknown key shedule",
+		filename + ":8:3: configuration not valid: duplicate job name restore",
+	}
+	got := strings.Split(errs.Error(), "\n")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors %q, want %q", got, want)
+	}
+}
+
+func TestConfigErrorsOrder(t *testing.T) {
+	errs := ConfigErrors{
+		{File: "b.yml", Line: 1, Column: 1, Message: "4"},
+		{File: "a.yml", Line: 10, Column: 1, Message: "3"},
+		{File: "a.yml", Line: 2, Column: 7, Message: "2"},
+		{File: "a.yml", Message: "0"},
+		{File: "a.yml", Line: 2, Column: 3, Message: "1"},
+	}
+	sort.Stable(errs)
+	for i, err := range errs {
+		if err.Message != strconv.Itoa(i) {
+			t.Errorf("error %d is %v", i, err)
+		}
+	}
+}
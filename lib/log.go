@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying a logger, whose fields are attached
+// to everything logged while running a job.
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger carried by a context, or the standard one.
+func LoggerFrom(ctx context.Context) *logrus.Entry {
+	logger, ok := ctx.Value(loggerKey{}).(*logrus.Entry)
+	if !ok {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return logger
+}
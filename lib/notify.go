@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EventSuccess   = "success"
+	EventFailure   = "failure"
+	EventTimeout   = "timeout"
+	EventRecovered = "recovered"
+
+	SignatureHeader = "X-Docker-Executor-Signature"
+
+	webhookTimeout = 10 * time.Second
+	webhookBackoff = time.Second
+)
+
+// defaultEvents are the events notified when none is given.
+var defaultEvents = []string{EventFailure, EventTimeout}
+
+// Notifications lists where the outcome of the runs is sent.
+type Notifications struct {
+	Webhooks []Webhook `yaml:"webhooks"`
+	Emails   []Email   `yaml:"emails"`
+}
+
+// Webhook POSTs a json payload describing a run to a url. The payload can be
+// replaced by a template, and signed with HMAC-SHA256 when a secret is given.
+type Webhook struct {
+	Url     string            `yaml:"url"`
+	On      []string          `yaml:"on"`
+	Body    string            `yaml:"body"`
+	Headers map[string]string `yaml:"headers"`
+	Secret  string            `yaml:"secret"`
+	Retries int               `yaml:"retries"`
+}
+
+// Notification is the payload sent for a run, and the data available to
+// templates, which can also access the lines of output of the run.
+type Notification struct {
+	Event  string
+	Run    Run
+	Output []string `json:"-"`
+}
+
+func validateEvents(events []string) error {
+	for _, event := range events {
+		switch event {
+		case EventSuccess, EventFailure, EventTimeout, EventRecovered:
+		default:
+			return errors.Errorf("unknown event %s, must be success, failure, timeout or recovered", event)
+		}
+	}
+	return nil
+}
+
+func validateNotifications(notifications Notifications) error {
+	for _, webhook := range notifications.Webhooks {
+		u, err := url.Parse(webhook.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.Errorf("webhook url %s must be a valid http or https url", webhook.Url)
+		}
+		err = validateEvents(webhook.On)
+		if err != nil {
+			return err
+		}
+		if webhook.Body != "" {
+			_, err = template.New("").Parse(webhook.Body)
+			if err != nil {
+				return errors.Wrap(err, "invalid webhook body template")
+			}
+		}
+		if webhook.Retries < 0 {
+			return errors.New("webhook retries must not be negative")
+		}
+	}
+	for _, email := range notifications.Emails {
+		err := validateEmail(email)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunEvents returns the events raised by a run, most specific first, given
+// the run of the same job before it, if any.
+func RunEvents(run Run, previous *Run) []string {
+	switch run.Status {
+	case RunStatusSuccess:
+		if previous != nil && previous.Status != RunStatusSuccess {
+			return []string{EventRecovered, EventSuccess}
+		}
+		return []string{EventSuccess}
+	case RunStatusFailure:
+		return []string{EventFailure}
+	case RunStatusTimeout:
+		return []string{EventTimeout}
+	}
+	return nil
+}
+
+// matchEvent returns the first of the raised events the subscriber listens
+// to, or an empty string.
+func matchEvent(raised []string, on []string) string {
+	if len(on) == 0 {
+		on = defaultEvents
+	}
+	for _, event := range raised {
+		for _, o := range on {
+			if event == o {
+				return event
+			}
+		}
+	}
+	return ""
+}
+
+// Notifier sends the notifications configured globally and for each job.
+type Notifier struct {
+	config  *Config
+	client  *http.Client
+	backoff time.Duration
+}
+
+func NewNotifier(config *Config) *Notifier {
+	return &Notifier{
+		config:  config,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: webhookBackoff,
+	}
+}
+
+// Notify sends, in the background, the notifications raised by a run.
+func (n *Notifier) Notify(run Run, previous *Run, logs []byte) {
+	raised := RunEvents(run, previous)
+	if len(raised) == 0 {
+		return
+	}
+	var output []string
+	if len(logs) > 0 {
+		output = PrepareOutput(logs)
+	}
+
+	webhooks := append(append([]Webhook{}, n.config.Notifications.Webhooks...), n.config.Jobs[run.JobName].Notifications.Webhooks...)
+	for _, webhook := range webhooks {
+		event := matchEvent(raised, webhook.On)
+		if event == "" {
+			continue
+		}
+		go func(webhook Webhook, notification Notification) {
+			err := n.sendWebhook(webhook, notification)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"job": run.JobName, "run_id": run.ID, "webhook": webhook.Url}).WithError(err).Error("unable to send webhook notification")
+			}
+		}(webhook, Notification{Event: event, Run: run, Output: output})
+	}
+
+	emails := append(append([]Email{}, n.config.Notifications.Emails...), n.config.Jobs[run.JobName].Notifications.Emails...)
+	for _, email := range emails {
+		event := matchEvent(raised, email.On)
+		if event == "" {
+			continue
+		}
+		go func(email Email, notification Notification) {
+			msg, err := emailMessage(n.config.Smtp, email, notification)
+			if err == nil {
+				err = sendEmail(n.config.Smtp, email.To, msg)
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"job": run.JobName, "run_id": run.ID, "to": strings.Join(email.To, ", ")}).WithError(err).Error("unable to send email notification")
+			}
+		}(email, Notification{Event: event, Run: run, Output: output})
+	}
+}
+
+func webhookBody(webhook Webhook, notification Notification) ([]byte, error) {
+	if webhook.Body == "" {
+		return json.Marshal(notification)
+	}
+	tpl, err := template.New("").Parse(webhook.Body)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, notification)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign returns the signature of a webhook body, as sent in SignatureHeader.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook POSTs a notification, retrying with exponential backoff on
+// network errors and on 429 and 5xx responses.
+func (n *Notifier) sendWebhook(webhook Webhook, notification Notification) error {
+	body, err := webhookBody(webhook, notification)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.postWebhook(webhook, body)
+		if err == nil || attempt >= webhook.Retries {
+			return err
+		}
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// permanentError is an error not worth retrying.
+type permanentError struct {
+	error
+}
+
+func (n *Notifier) postWebhook(webhook Webhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range webhook.Headers {
+		req.Header.Set(key, value)
+	}
+	if webhook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(body, webhook.Secret))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return errors.Errorf("webhook responded %s", res.Status)
+	case res.StatusCode >= 300:
+		return permanentError{errors.Errorf("webhook responded %s", res.Status)}
+	}
+	return nil
+}
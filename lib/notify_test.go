@@ -0,0 +1,224 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request is a webhook call received by a webhookServer.
+type request struct {
+	header http.Header
+	body   string
+}
+
+// webhookServer records the calls it gets, answering with the given status
+// codes in turn, then with 200.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests chan request
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses, requests: make(chan request, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests <- request{r.Header, string(body)}
+		s.mu.Lock()
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func testNotifier(config *Config) *Notifier {
+	n := NewNotifier(config)
+	n.backoff = time.Millisecond
+	return n
+}
+
+var notifiedRun = Run{
+	ID:        "run-1",
+	JobName:   "backup",
+	Trigger:   "schedule",
+	StartTime: time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC),
+	EndTime:   time.Date(2024, 1, 1, 3, 0, 5, 0, time.UTC),
+	Status:    RunStatusFailure,
+	ExitCode:  2,
+	Error:     "exited with code 2",
+}
+
+func TestWebhookPayload(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	n := testNotifier(&Config{})
+
+	notification := Notification{Event: EventFailure, Run: notifiedRun, Output: []string{"dumping", "disk full"}}
+	err := n.sendWebhook(Webhook{Url: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}}, notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-server.requests
+	if req.header.Get("Content-Type") != "application/json" || req.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers %v", req.header)
+	}
+	if req.header.Get(SignatureHeader) != "" {
+		t.Errorf("signed without a secret: %s", req.header.Get(SignatureHeader))
+	}
+	var payload struct {
+		Event  string
+		Run    Run
+		Output []string
+	}
+	err = json.Unmarshal([]byte(req.body), &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != EventFailure || payload.Run.ID != "run-1" || payload.Run.ExitCode != 2 || payload.Run.Error != "exited with code 2" {
+		t.Errorf("payload %s", req.body)
+	}
+	if payload.Output != nil {
+		t.Errorf("output sent in the default payload: %s", req.body)
+	}
+
+	body := `{"text": "{{ .Run.JobName }} {{ .Event }}: {{ index .Output 1 }}"}`
+	err = n.sendWebhook(Webhook{Url: server.URL, Body: body}, notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = <-server.requests
+	if req.body != `{"text": "backup failure: disk full"}` {
+		t.Errorf("templated payload %s", req.body)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	n := testNotifier(&Config{})
+
+	err := n.sendWebhook(Webhook{Url: server.URL, Secret: "s3cret"}, Notification{Event: EventFailure, Run: notifiedRun})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-server.requests
+	if got := req.header.Get(SignatureHeader); got != Sign([]byte(req.body), "s3cret") {
+		t.Errorf("signature %s of %s", got, req.body)
+	}
+
+	// HMAC-SHA256 of "hello" keyed with "key"
+	want := "sha256=9307b3b915efb5171ff14d8cb55fbcc798c6c0ef1456d66ded1a6aa723a58b7b"
+	if got := Sign([]byte("hello"), "key"); got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		calls    int
+		fails    bool
+	}{
+		{"no retries", []int{503}, 0, 1, true},
+		{"recovers", []int{503, 429}, 2, 3, false},
+		{"gives up", []int{500, 502, 503}, 2, 3, true},
+		{"client error", []int{400}, 3, 1, true},
+		{"redirect", []int{304}, 3, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newWebhookServer(test.statuses...)
+			defer server.Close()
+			n := testNotifier(&Config{})
+
+			err := n.sendWebhook(Webhook{Url: server.URL, Retries: test.retries}, Notification{Event: EventFailure, Run: notifiedRun})
+			if (err != nil) != test.fails {
+				t.Errorf("error %v", err)
+			}
+			if len(server.requests) != test.calls {
+				t.Errorf("%d calls, want %d", len(server.requests), test.calls)
+			}
+		})
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	success := Run{Status: RunStatusSuccess}
+	failure := Run{Status: RunStatusFailure}
+	tests := []struct {
+		run      Run
+		previous *Run
+		on       []string
+		want     string
+	}{
+		{failure, nil, nil, EventFailure},
+		{Run{Status: RunStatusTimeout}, nil, nil, EventTimeout},
+		{success, nil, nil, ""},
+		{success, &failure, nil, ""},
+		{success, &failure, []string{EventSuccess}, EventSuccess},
+		{success, &failure, []string{EventSuccess, EventRecovered}, EventRecovered},
+		{success, &success, []string{EventRecovered}, ""},
+		{Run{Status: RunStatusSkipped}, nil, []string{EventSuccess, EventFailure}, ""},
+	}
+	for _, test := range tests {
+		got := matchEvent(RunEvents(test.run, test.previous), test.on)
+		if got != test.want {
+			t.Errorf("%s after %v on %v: event %q, want %q", test.run.Status, test.previous, test.on, got, test.want)
+		}
+	}
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	global := newWebhookServer()
+	defer global.Close()
+	job := newWebhookServer()
+	defer job.Close()
+	other := newWebhookServer()
+	defer other.Close()
+
+	config := &Config{
+		Notifications: Notifications{Webhooks: []Webhook{{Url: global.URL}}},
+		Jobs: map[string]Job{
+			"backup": {Notifications: Notifications{Webhooks: []Webhook{
+				{Url: job.URL, On: []string{EventRecovered}},
+				{Url: other.URL, On: []string{EventTimeout}},
+			}}},
+		},
+	}
+	n := testNotifier(config)
+
+	n.Notify(notifiedRun, nil, []byte("dumping\ndisk full\n"))
+	req := <-global.requests
+	if !strings.Contains(req.body, `"Event":"failure"`) {
+		t.Errorf("global webhook payload %s", req.body)
+	}
+
+	recovered := notifiedRun
+	recovered.Status = RunStatusSuccess
+	n.Notify(recovered, &notifiedRun, nil)
+	req = <-job.requests
+	if !strings.Contains(req.body, `"Event":"recovered"`) {
+		t.Errorf("job webhook payload %s", req.body)
+	}
+
+	select {
+	case req := <-global.requests:
+		t.Errorf("global webhook called on success: %s", req.body)
+	case req := <-other.requests:
+		t.Errorf("timeout webhook called: %s", req.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	OutputFromLastLine = "last_line"
+	OutputFromJson     = "json"
+	OutputFromFile     = "file"
+)
+
+// JobOutput declares the value a job hands over to the jobs running after it.
+type JobOutput struct {
+	From string `yaml:"from"`
+	Path string `yaml:"path"`
+}
+
+// JobResult is what running a job produces: the exit code, the tail of the
+// combined logs, whether older logs were dropped and, if the job declares
+// one, its output.
+type JobResult struct {
+	ExitCode  int64
+	Logs      []byte
+	Truncated bool
+	Output    interface{}
+	Tasks     []TaskRecord
+}
+
+func validateOutput(output *JobOutput, jobType string) error {
+	switch output.From {
+	case OutputFromLastLine, OutputFromJson:
+		if output.Path != "" {
+			return errors.New("output path is only allowed when output is taken from a file")
+		}
+	case OutputFromFile:
+		if jobType != JobTypeRun {
+			return errors.New("output can be taken from a file only for run jobs")
+		}
+		if output.Path == "" {
+			return errors.New("output path must not be empty")
+		}
+	default:
+		return errors.New("output can only be taken from last_line, json or file")
+	}
+	return nil
+}
+
+// readFileFromTar returns the content of the first regular file in a tar
+// archive, as returned by CopyFromContainer.
+func readFileFromTar(archive io.Reader) ([]byte, error) {
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("archive does not contain a regular file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// PrepareOutput splits logs into lines, dropping non printable characters.
+func PrepareOutput(in []byte) []string {
+	return strings.Split(strings.Trim(printable(string(in)), "\n"), "\n")
+}
+
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func lastLine(in []byte) string {
+	lines := strings.Split(strings.TrimRight(string(in), "\r\n"), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func extractOutput(output *JobOutput, stdout []byte, file []byte) (interface{}, error) {
+	switch output.From {
+	case OutputFromLastLine:
+		return lastLine(stdout), nil
+	case OutputFromJson:
+		var value interface{}
+		err := json.Unmarshal(bytes.TrimSpace(stdout), &value)
+		if err != nil {
+			return nil, errors.Wrap(err, "stdout is not valid json")
+		}
+		return value, nil
+	case OutputFromFile:
+		return strings.TrimRight(string(file), "\r\n"), nil
+	}
+	return nil, errors.Errorf("unknown output source %s", output.From)
+}
+
+// Outputs keeps the last output produced by every job, so that it can be
+// used in the env and cmd of other jobs as {{ .Outputs.job_name }}.
+type Outputs struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func NewOutputs() *Outputs {
+	return &Outputs{values: make(map[string]interface{})}
+}
+
+func (o *Outputs) Set(jobName string, value interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.values[jobName] = value
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(text)
+}
+
+func validateTemplates(job Job) error {
+	for _, s := range append(append([]string{}, job.Env...), job.Cmd...) {
+		_, err := parseTemplate(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid template %q", s)
+		}
+	}
+	return nil
+}
+
+func (o *Outputs) render(text string, data interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tpl, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Render returns a copy of the job where the templates in env and cmd are
+// replaced with the outputs of the other jobs.
+func (o *Outputs) Render(job Job) (Job, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	data := struct{ Outputs map[string]interface{} }{Outputs: o.values}
+
+	env := make([]string, len(job.Env))
+	for i, s := range job.Env {
+		rendered, err := o.render(s, data)
+		if err != nil {
+			return job, errors.Wrap(err, "unable to render env")
+		}
+		env[i] = rendered
+	}
+
+	cmd := make([]string, len(job.Cmd))
+	for i, s := range job.Cmd {
+		rendered, err := o.render(s, data)
+		if err != nil {
+			return job, errors.Wrap(err, "unable to render cmd")
+		}
+		cmd[i] = rendered
+	}
+
+	if job.Env != nil {
+		job.Env = env
+	}
+	if job.Cmd != nil {
+		job.Cmd = cmd
+	}
+	return job, nil
+}
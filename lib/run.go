@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TriggerSchedule = "schedule"
+	TriggerApi      = "api"
+	TriggerAfter    = "after"
+	TriggerCatchup  = "catchup"
+	TriggerCli      = "cli"
+
+	RunStatusSuccess = "success"
+	RunStatusFailure = "failure"
+	RunStatusTimeout = "timeout"
+	RunStatusSkipped = "skipped"
+)
+
+// Run records a single execution of a job.
+type Run struct {
+	ID            string
+	JobName       string
+	Trigger       string
+	ScheduledTime time.Time `json:",omitempty"`
+	StartTime     time.Time
+	EndTime       time.Time
+	Status        string
+	ExitCode      int64
+	Truncated     bool         `json:",omitempty"`
+	Error         string       `json:",omitempty"`
+	Tasks         []TaskRecord `json:",omitempty"`
+}
+
+// TaskRecord records a swarm task of a service run: where it ran and the
+// states it went through.
+type TaskRecord struct {
+	ID          string
+	Slot        int    `json:",omitempty"`
+	NodeID      string `json:",omitempty"`
+	Node        string `json:",omitempty"`
+	ContainerID string `json:",omitempty"`
+	State       string
+	Message     string           `json:",omitempty"`
+	Error       string           `json:",omitempty"`
+	ExitCode    int              `json:",omitempty"`
+	Timeline    []TaskTransition `json:",omitempty"`
+}
+
+// TaskTransition is a state a task was seen in.
+type TaskTransition struct {
+	Time    time.Time
+	State   string
+	Message string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+func newRunId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewRun starts recording a run of a job.
+func NewRun(jobName string, trigger string, scheduledTime time.Time) *Run {
+	return &Run{
+		ID:            newRunId(),
+		JobName:       jobName,
+		Trigger:       trigger,
+		ScheduledTime: scheduledTime,
+		StartTime:     time.Now(),
+	}
+}
+
+// Skip completes the record of a run which did not take place.
+func (run *Run) Skip(reason string) {
+	run.EndTime = run.StartTime
+	run.Status = RunStatusSkipped
+	run.Error = reason
+}
+
+// Finish completes the record with the outcome of the run.
+func (run *Run) Finish(result *JobResult, err error) {
+	run.EndTime = time.Now()
+	if result != nil {
+		run.ExitCode = result.ExitCode
+		run.Truncated = result.Truncated
+		run.Tasks = result.Tasks
+	}
+	switch {
+	case errors.Cause(err) == context.DeadlineExceeded:
+		run.Status = RunStatusTimeout
+		run.Error = err.Error()
+	case err != nil:
+		run.Status = RunStatusFailure
+		run.Error = err.Error()
+	case run.ExitCode != 0:
+		run.Status = RunStatusFailure
+	default:
+		run.Status = RunStatusSuccess
+	}
+}
+
+// Duration returns how long the run took.
+func (run Run) Duration() time.Duration {
+	return run.EndTime.Sub(run.StartTime)
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/pkg/errors"
+)
+
+var timezonePrefixes = []string{"CRON_TZ=", "TZ="}
+
+// hashedField matches the H syntax: H, H/step, H(min-max) and H(min-max)/step.
+var hashedField = regexp.MustCompile(`^H(?:\((\d+)-(\d+)\))?(?:/(\d+))?$`)
+
+type fieldRange struct {
+	min, max int
+}
+
+var (
+	secondRange     = fieldRange{0, 59}
+	minuteRange     = fieldRange{0, 59}
+	hourRange       = fieldRange{0, 23}
+	dayOfMonthRange = fieldRange{1, 28}
+	monthRange      = fieldRange{1, 12}
+	dayOfWeekRange  = fieldRange{0, 6}
+)
+
+// Schedule is a cron expression evaluated in a given timezone, with an
+// optional random delay added to every fire time.
+//
+// Cron fields are matched against the wall clock of the timezone, so DST
+// changes are handled as follows:
+//   - fire times falling in the hour skipped when clocks go forward are moved
+//     forward by the length of the gap (02:30 becomes 03:30); if that time
+//     already matches the expression the two runs are merged into one
+//   - fire times falling in the hour repeated when clocks go back run only
+//     once, on their first occurrence
+type Schedule struct {
+	expr     *cronexpr.Expression
+	location *time.Location
+	jitter   time.Duration
+}
+
+// ParseSchedule parses a cron expression, optionally prefixed by
+// CRON_TZ=<zone> (or TZ=<zone>), which takes precedence over timezone.
+// An empty timezone means the local one. Fields using the H syntax get a
+// value derived from hashKey, so that it is spread but stable across runs.
+func ParseSchedule(spec string, timezone string, hashKey string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	for _, prefix := range timezonePrefixes {
+		if strings.HasPrefix(spec, prefix) {
+			fields := strings.SplitN(strings.TrimPrefix(spec, prefix), " ", 2)
+			if len(fields) != 2 {
+				return nil, errors.New("missing cron expression after timezone")
+			}
+			timezone, spec = fields[0], strings.TrimSpace(fields[1])
+			break
+		}
+	}
+
+	location, err := loadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err = expandHashedFields(spec, hashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := cronexpr.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Schedule{expr: expr, location: location}, nil
+}
+
+// expandHashedFields replaces the H fields of a cron expression with the
+// values they stand for.
+func expandHashedFields(spec string, hashKey string) (string, error) {
+	fields := strings.Fields(spec)
+	var ranges []fieldRange
+	switch len(fields) {
+	case 5, 6:
+		ranges = []fieldRange{minuteRange, hourRange, dayOfMonthRange, monthRange, dayOfWeekRange}
+	case 7:
+		ranges = []fieldRange{secondRange, minuteRange, hourRange, dayOfMonthRange, monthRange, dayOfWeekRange}
+	default:
+		return spec, nil
+	}
+
+	for i, field := range fields {
+		if !strings.Contains(field, "H") {
+			continue
+		}
+		if i >= len(ranges) {
+			return "", errors.New("H is not allowed in the year field")
+		}
+		items := strings.Split(field, ",")
+		for j, item := range items {
+			expanded, err := expandHashedItem(item, ranges[i], hashOf(hashKey, i))
+			if err != nil {
+				return "", err
+			}
+			items[j] = expanded
+		}
+		fields[i] = strings.Join(items, ",")
+	}
+	return strings.Join(fields, " "), nil
+}
+
+func expandHashedItem(item string, r fieldRange, hash int) (string, error) {
+	matches := hashedField.FindStringSubmatch(item)
+	if matches == nil {
+		if strings.HasPrefix(item, "H") {
+			return "", errors.Errorf("invalid hashed field %s", item)
+		}
+		return item, nil
+	}
+
+	if matches[1] != "" {
+		min, _ := strconv.Atoi(matches[1])
+		max, _ := strconv.Atoi(matches[2])
+		if min > max || min < r.min || max > r.max {
+			return "", errors.Errorf("invalid range in hashed field %s", item)
+		}
+		r = fieldRange{min, max}
+	}
+
+	if matches[3] == "" {
+		return strconv.Itoa(r.min + hash%(r.max-r.min+1)), nil
+	}
+
+	step, _ := strconv.Atoi(matches[3])
+	if step == 0 {
+		return "", errors.Errorf("invalid step in hashed field %s", item)
+	}
+	return fmt.Sprintf("%d-%d/%d", r.min+hash%step, r.max, step), nil
+}
+
+// hashOf returns a stable non negative hash of a key for a given field, so
+// that the fields of the same expression do not get the same value.
+func hashOf(key string, field int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key + "/" + strconv.Itoa(field)))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// WithJitter returns a copy of the schedule delaying every fire time by a
+// random duration up to jitter.
+func (s *Schedule) WithJitter(jitter time.Duration) *Schedule {
+	schedule := *s
+	schedule.jitter = jitter
+	return &schedule
+}
+
+// Jitter returns the maximum random delay added to the fire times.
+func (s *Schedule) Jitter() time.Duration {
+	return s.jitter
+}
+
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, errors.Errorf("unknown timezone %s", timezone)
+	}
+	return location, nil
+}
+
+// Location returns the timezone the schedule is evaluated in.
+func (s *Schedule) Location() *time.Location {
+	return s.location
+}
+
+// Next returns the first fire time strictly after from, or the zero time if
+// the expression never matches again.
+func (s *Schedule) Next(from time.Time) time.Time {
+	from = from.In(s.location)
+	wall := toWall(from)
+	for {
+		wall = s.expr.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		next := time.Time{}
+		for _, t := range s.fromWall(wall) {
+			if t.After(from) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+}
+
+// NextN returns the next n fire times after from.
+func (s *Schedule) NextN(from time.Time, n int) []time.Time {
+	times := make([]time.Time, 0, n)
+	for len(times) < n {
+		from = s.Next(from)
+		if from.IsZero() {
+			break
+		}
+		times = append(times, from)
+	}
+	return times
+}
+
+// toWall returns the wall clock of t as a UTC time, so that cron fields can be
+// matched without DST getting in the way.
+func toWall(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// fromWall returns the instants showing the given wall clock in the schedule
+// timezone: two in a DST overlap, one otherwise. A wall clock falling in a DST
+// gap is normalized past it.
+func (s *Schedule) fromWall(wall time.Time) []time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), s.location)
+	instants := []time.Time{t}
+	_, offset := t.Zone()
+	for _, probe := range []time.Time{t.Add(-12 * time.Hour), t.Add(12 * time.Hour)} {
+		_, probeOffset := probe.Zone()
+		if probeOffset == offset {
+			continue
+		}
+		other := t.Add(time.Duration(offset-probeOffset) * time.Second)
+		if toWall(other).Equal(wall) {
+			instants = append(instants, other)
+		}
+	}
+	return instants
+}
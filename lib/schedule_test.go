@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextTimes returns the fire times of a schedule from a given wall clock in
+// its timezone, formatted with their offset.
+func nextTimes(t *testing.T, spec string, timezone string, from string, n int) []string {
+	schedule, err := ParseSchedule(spec, timezone, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, err := time.ParseInLocation("2006-01-02 15:04", from, schedule.Location())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []string
+	for _, next := range schedule.NextN(start, n) {
+		times = append(times, next.Format("2006-01-02 15:04 -0700"))
+	}
+	return times
+}
+
+func TestScheduleDST(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want []string
+	}{
+		{
+			name: "spring forward gap",
+			spec: "30 2 * * *",
+			from: "2024-03-30 12:00",
+			want: []string{"2024-03-31 03:30 +0200", "2024-04-01 02:30 +0200"},
+		},
+		{
+			name: "spring forward merged",
+			spec: "0 2,3 * * *",
+			from: "2024-03-31 00:00",
+			want: []string{"2024-03-31 03:00 +0200", "2024-04-01 02:00 +0200", "2024-04-01 03:00 +0200"},
+		},
+		{
+			name: "spring forward hourly",
+			spec: "15 * * * *",
+			from: "2024-03-31 01:00",
+			want: []string{"2024-03-31 01:15 +0100", "2024-03-31 03:15 +0200", "2024-03-31 04:15 +0200"},
+		},
+		{
+			name: "fall back once",
+			spec: "30 2 * * *",
+			from: "2024-10-26 12:00",
+			want: []string{"2024-10-27 02:30 +0200", "2024-10-28 02:30 +0100"},
+		},
+		{
+			name: "fall back hourly",
+			spec: "30 * * * *",
+			from: "2024-10-27 01:00",
+			want: []string{"2024-10-27 01:30 +0200", "2024-10-27 02:30 +0200", "2024-10-27 03:30 +0100"},
+		},
+	}
+	for _, test := range tests {
+		got := nextTimes(t, test.spec, "Europe/Paris", test.from, len(test.want))
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: fire times %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScheduleFromWall(t *testing.T) {
+	schedule, err := ParseSchedule("* * * * *", "Europe/Paris", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		wall string
+		want []string
+	}{
+		{"2024-06-01 12:00", []string{"2024-06-01 12:00 +0200"}},
+		{"2024-03-31 02:30", []string{"2024-03-31 03:30 +0200"}},
+		{"2024-10-27 02:30", []string{"2024-10-27 02:30 +0100", "2024-10-27 02:30 +0200"}},
+	}
+	for _, test := range tests {
+		wall, _ := time.Parse("2006-01-02 15:04", test.wall)
+		var got []string
+		for _, instant := range schedule.fromWall(wall) {
+			got = append(got, instant.Format("2006-01-02 15:04 -0700"))
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: instants %v, want %v", test.wall, got, test.want)
+		}
+	}
+
+	summer := time.Date(2024, 6, 1, 12, 0, 0, 0, schedule.Location())
+	if wall := toWall(summer); !wall.Equal(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("wall clock %v", wall)
+	}
+}
+
+func TestScheduleTimezonePrefix(t *testing.T) {
+	for _, spec := range []string{"CRON_TZ=America/New_York 0 9 * * *", "TZ=America/New_York 0 9 * * *", "  CRON_TZ=America/New_York   0 9 * * *"} {
+		schedule, err := ParseSchedule(spec, "Europe/Paris", "job")
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if schedule.Location().String() != "America/New_York" {
+			t.Errorf("%s: location %s", spec, schedule.Location())
+		}
+		next := schedule.Next(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+		if !next.Equal(time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: next %v", spec, next)
+		}
+	}
+
+	for spec, message := range map[string]string{
+		"CRON_TZ=America/New_York":  "missing cron expression after timezone",
+		"TZ=Mars/Olympus 0 9 * * *": "unknown timezone Mars/Olympus",
+	} {
+		_, err := ParseSchedule(spec, "", "job")
+		if err == nil || err.Error() != message {
+			t.Errorf("%s: error %v, want %q", spec, err, message)
+		}
+	}
+}
+
+func TestExpandHashedItem(t *testing.T) {
+	tests := []struct {
+		item string
+		r    fieldRange
+		hash int
+		want string
+	}{
+		{"H", minuteRange, 0, "0"},
+		{"H", minuteRange, 59, "59"},
+		{"H", minuteRange, 60, "0"},
+		{"H", dayOfMonthRange, 0, "1"},
+		{"H", dayOfMonthRange, 27, "28"},
+		{"H", dayOfMonthRange, 28, "1"},
+		{"H/15", minuteRange, 7, "7-59/15"},
+		{"H/15", minuteRange, 22, "7-59/15"},
+		{"H(0-29)", minuteRange, 30, "0"},
+		{"H(0-29)", minuteRange, 45, "15"},
+		{"H(10-20)/5", minuteRange, 3, "13-20/5"},
+		{"5", minuteRange, 3, "5"},
+		{"*/5", minuteRange, 3, "*/5"},
+	}
+	for _, test := range tests {
+		got, err := expandHashedItem(test.item, test.r, test.hash)
+		if err != nil || got != test.want {
+			t.Errorf("%s with hash %d: %s, %v, want %s", test.item, test.hash, got, err, test.want)
+		}
+	}
+
+	for item, message := range map[string]string{
+		"H(30-10)": "invalid range in hashed field H(30-10)",
+		"H(0-60)":  "invalid range in hashed field H(0-60)",
+		"H/0":      "invalid step in hashed field H/0",
+		"Hx":       "invalid hashed field Hx",
+	} {
+		_, err := expandHashedItem(item, minuteRange, 0)
+		if err == nil || err.Error() != message {
+			t.Errorf("%s: error %v, want %q", item, err, message)
+		}
+	}
+}
+
+func TestExpandHashedFields(t *testing.T) {
+	ranges := []fieldRange{minuteRange, hourRange, dayOfMonthRange, monthRange, dayOfWeekRange}
+	spreads := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		name := "job-" + strconv.Itoa(i)
+		spec, err := expandHashedFields("H H H H H", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := expandHashedFields("H H H H H", name)
+		if spec != again {
+			t.Errorf("%s: expanded to %s then %s", name, spec, again)
+		}
+		spreads[spec] = true
+		for j, field := range strings.Fields(spec) {
+			value, err := strconv.Atoi(field)
+			if err != nil || value < ranges[j].min || value > ranges[j].max {
+				t.Errorf("%s: field %d is %s, out of %v", name, j, field, ranges[j])
+			}
+		}
+
+		spec, _ = expandHashedFields("H/15 H(0-5) * * *", name)
+		var start, hour int
+		_, err = fmt.Sscanf(spec, "%d-59/15 %d * * *", &start, &hour)
+		if err != nil || start < 0 || start >= 15 || hour < 0 || hour > 5 {
+			t.Errorf("%s: expanded to %s", name, spec)
+		}
+	}
+	if len(spreads) < 150 {
+		t.Errorf("only %d distinct expansions for 200 jobs", len(spreads))
+	}
+
+	seconds, _ := expandHashedFields("H H * * * * *", "job")
+	for _, field := range strings.Fields(seconds)[:2] {
+		value, err := strconv.Atoi(field)
+		if err != nil || value < 0 || value > 59 {
+			t.Errorf("seconds and minutes not expanded: %s", seconds)
+		}
+	}
+	if _, err := expandHashedFields("0 0 0 * * * H", "job"); err == nil {
+		t.Error("H allowed in the year field")
+	}
+}
+
+func TestHashedSchedule(t *testing.T) {
+	a, err := ParseSchedule("H H * * *", "UTC", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ParseSchedule("H H * * *", "UTC", "backup")
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	if !a.Next(from).Equal(b.Next(from)) {
+		t.Errorf("same job fires at %v and %v", a.Next(from), b.Next(from))
+	}
+	if next := a.Next(from); next.Sub(from) > 24*time.Hour {
+		t.Errorf("daily job fires at %v", next)
+	}
+
+	jittered := a.WithJitter(time.Minute)
+	if jittered.Jitter() != time.Minute || a.Jitter() != 0 {
+		t.Errorf("jitter %v, original jitter %v", jittered.Jitter(), a.Jitter())
+	}
+	if !jittered.Next(from).Equal(a.Next(from)) {
+		t.Errorf("jittered schedule fires at %v, want %v", jittered.Next(from), a.Next(from))
+	}
+}
@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HeartbeatInterval is the longest the scheduler waits between checks for due
+// jobs, telling it is alive.
+const HeartbeatInterval = 10 * time.Second
+
+// Clock is the source of time of the scheduler, so that it can be replaced
+// in tests.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of time.Timer used by the scheduler.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type systemClock struct{}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// FireFunc is called, in its own goroutine, every time a job is due.
+type FireFunc func(jobName string, scheduledTime time.Time)
+
+// ScheduledJob is a job known to the scheduler with its next fire time.
+type ScheduledJob struct {
+	Name string
+	Next time.Time
+}
+
+// scheduleEntry is a scheduled job. Its next fire time is the one given by
+// the schedule, while fireAt also includes the jitter.
+type scheduleEntry struct {
+	name     string
+	schedule *Schedule
+	next     time.Time
+	fireAt   time.Time
+	index    int
+}
+
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int {
+	return len(q)
+}
+
+func (q scheduleQueue) Less(i, j int) bool {
+	return q[i].fireAt.Before(q[j].fireAt)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	entry := x.(*scheduleEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	entry.index = -1
+	return entry
+}
+
+// Scheduler fires jobs according to their schedules. It keeps the jobs in a
+// priority queue ordered by next fire time and waits on a single timer for
+// the first of them.
+type Scheduler struct {
+	clock   Clock
+	fire    FireFunc
+	random  *rand.Rand
+	mu      sync.Mutex
+	queue   scheduleQueue
+	entries map[string]*scheduleEntry
+	changed chan struct{}
+	ticked  time.Time
+}
+
+func NewScheduler(clock Clock, fire FireFunc) *Scheduler {
+	return &Scheduler{
+		clock:   clock,
+		fire:    fire,
+		random:  rand.New(rand.NewSource(clock.Now().UnixNano())),
+		entries: make(map[string]*scheduleEntry),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Add schedules a job. It fails if the job is already scheduled.
+func (s *Scheduler) Add(name string, schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[name]; ok {
+		return errors.Errorf("job %s is already scheduled", name)
+	}
+	s.push(name, schedule)
+	return nil
+}
+
+// Update replaces the schedule of a job. It fails if the job is not
+// scheduled.
+func (s *Scheduler) Update(name string, schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[name]
+	if !ok {
+		return errors.Errorf("job %s is not scheduled", name)
+	}
+	s.remove(entry)
+	s.push(name, schedule)
+	return nil
+}
+
+// Remove unschedules a job, if it is scheduled.
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[name]
+	if ok {
+		s.remove(entry)
+		s.notify()
+	}
+}
+
+// Upcoming returns the next n fire times of a job.
+func (s *Scheduler) Upcoming(name string, n int) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[name]
+	if !ok || n <= 0 {
+		return []time.Time{}
+	}
+	return append([]time.Time{entry.next}, entry.schedule.NextN(entry.next, n-1)...)
+}
+
+// Jobs returns the scheduled jobs, ordered by next fire time.
+func (s *Scheduler) Jobs() []ScheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]ScheduledJob, 0, len(s.queue))
+	for _, entry := range s.queue {
+		jobs = append(jobs, ScheduledJob{Name: entry.name, Next: entry.next})
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Next.Equal(jobs[j].Next) {
+			return jobs[i].Name < jobs[j].Name
+		}
+		return jobs[i].Next.Before(jobs[j].Next)
+	})
+	return jobs
+}
+
+func (s *Scheduler) push(name string, schedule *Schedule) {
+	next := schedule.Next(s.clock.Now())
+	if next.IsZero() {
+		return
+	}
+	entry := &scheduleEntry{name: name, schedule: schedule, next: next, fireAt: s.withJitter(next, schedule)}
+	s.entries[name] = entry
+	heap.Push(&s.queue, entry)
+	s.notify()
+}
+
+func (s *Scheduler) withJitter(next time.Time, schedule *Schedule) time.Time {
+	if schedule.Jitter() <= 0 {
+		return next
+	}
+	return next.Add(time.Duration(s.random.Int63n(int64(schedule.Jitter()))))
+}
+
+func (s *Scheduler) remove(entry *scheduleEntry) {
+	heap.Remove(&s.queue, entry.index)
+	delete(s.entries, entry.name)
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// fireDue fires the jobs that are due and returns the time until the next
+// one, or false if no job is scheduled.
+func (s *Scheduler) fireDue() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.ticked = now
+	for len(s.queue) > 0 && !s.queue[0].fireAt.After(now) {
+		entry := s.queue[0]
+		go s.fire(entry.name, entry.next)
+
+		// fire times are computed from the previous one, unless the
+		// scheduler fell behind them by more than the jitter
+		from := entry.next
+		if behind := now.Add(-entry.schedule.Jitter()); behind.After(from) {
+			from = behind
+		}
+		entry.next = entry.schedule.Next(from)
+		if entry.next.IsZero() {
+			s.remove(entry)
+		} else {
+			entry.fireAt = s.withJitter(entry.next, entry.schedule)
+			heap.Fix(&s.queue, 0)
+		}
+	}
+
+	if len(s.queue) == 0 {
+		return 0, false
+	}
+	return s.queue[0].fireAt.Sub(now), true
+}
+
+// LastTick returns when the scheduler last checked for due jobs, which it
+// does at least every heartbeat interval while running.
+func (s *Scheduler) LastTick() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ticked
+}
+
+// Run fires the jobs until the context is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		wait, ok := s.fireDue()
+		if !ok || wait > HeartbeatInterval {
+			wait = HeartbeatInterval
+		}
+		timer := s.clock.NewTimer(wait)
+
+		var err error
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timer.C():
+		case <-s.changed:
+		}
+
+		timer.Stop()
+		if err != nil {
+			return err
+		}
+	}
+}
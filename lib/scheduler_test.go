@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when advanced. Every timer
+// created is reported on waiting, which the scheduler blocks on until the
+// test receives it, so that the test knows when the scheduler is done with
+// the due jobs and waiting again.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	waiting chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waiting: make(chan time.Duration)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	timer := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.mu.Unlock()
+	c.waiting <- d
+	return timer
+}
+
+// Advance moves the time forward, firing the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return true
+}
+
+type firing struct {
+	name          string
+	scheduledTime time.Time
+}
+
+// startScheduler runs a scheduler on a fake clock with the given jobs,
+// recording the jobs fired.
+func startScheduler(t *testing.T, now time.Time, schedules map[string]*Schedule) (*Scheduler, *fakeClock, chan firing, func()) {
+	clock := newFakeClock(now)
+	fired := make(chan firing, 100)
+	s := NewScheduler(clock, func(name string, scheduledTime time.Time) {
+		fired <- firing{name, scheduledTime}
+	})
+	for name, schedule := range schedules {
+		if err := s.Add(name, schedule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the loop sees the jobs added before it runs without being notified
+	select {
+	case <-s.changed:
+	default:
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	<-clock.waiting
+	return s, clock, fired, func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("run returned %v", err)
+		}
+	}
+}
+
+// expectFired returns the next n jobs fired, ordered by scheduled time and
+// name, failing if fewer or more are fired.
+func expectFired(t *testing.T, fired chan firing, n int) []firing {
+	var firings []firing
+	for len(firings) < n {
+		select {
+		case f := <-fired:
+			firings = append(firings, f)
+		case <-time.After(time.Second):
+			t.Fatalf("fired %v, want %d jobs", firings, n)
+		}
+	}
+	select {
+	case f := <-fired:
+		t.Fatalf("fired %v and %v, want %d jobs", firings, f, n)
+	case <-time.After(20 * time.Millisecond):
+	}
+	sort.Slice(firings, func(i, j int) bool {
+		if firings[i].scheduledTime.Equal(firings[j].scheduledTime) {
+			return firings[i].name < firings[j].name
+		}
+		return firings[i].scheduledTime.Before(firings[j].scheduledTime)
+	})
+	return firings
+}
+
+func mustSchedule(t *testing.T, spec string) *Schedule {
+	schedule, err := ParseSchedule(spec, "UTC", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schedule
+}
+
+var schedulerStart = time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return time.Date(2024, 1, 1, 0, minutes, 0, 0, time.UTC)
+}
+
+func TestSchedulerFiresInOrder(t *testing.T) {
+	s, clock, fired, stop := startScheduler(t, schedulerStart, map[string]*Schedule{
+		"a": mustSchedule(t, "*/2 * * * *"),
+		"b": mustSchedule(t, "*/3 * * * *"),
+	})
+	defer stop()
+
+	jobs := s.Jobs()
+	if len(jobs) != 2 || jobs[0].Name != "a" || !jobs[0].Next.Equal(at(2)) || jobs[1].Name != "b" || !jobs[1].Next.Equal(at(3)) {
+		t.Errorf("jobs %v", jobs)
+	}
+
+	want := [][]firing{
+		nil,
+		{{"a", at(2)}},
+		{{"b", at(3)}},
+		{{"a", at(4)}},
+		nil,
+		{{"a", at(6)}, {"b", at(6)}},
+	}
+	for i, firings := range want {
+		clock.Advance(time.Minute)
+		<-clock.waiting
+		got := expectFired(t, fired, len(firings))
+		for j := range firings {
+			if got[j].name != firings[j].name || !got[j].scheduledTime.Equal(firings[j].scheduledTime) {
+				t.Errorf("minute %d: fired %v, want %v", i+1, got, firings)
+				break
+			}
+		}
+	}
+}
+
+func TestSchedulerAddRemove(t *testing.T) {
+	s, clock, fired, stop := startScheduler(t, schedulerStart, map[string]*Schedule{
+		"a": mustSchedule(t, "* * * * *"),
+	})
+	defer stop()
+
+	if err := s.Add("a", mustSchedule(t, "* * * * *")); err == nil {
+		t.Error("no error adding a job twice")
+	}
+	if err := s.Update("b", mustSchedule(t, "* * * * *")); err == nil {
+		t.Error("no error updating a job not scheduled")
+	}
+
+	clock.Advance(time.Minute)
+	<-clock.waiting
+	expectFired(t, fired, 1)
+
+	s.Remove("a")
+	<-clock.waiting
+	s.Remove("a")
+	if len(s.Jobs()) != 0 {
+		t.Errorf("jobs %v", s.Jobs())
+	}
+	clock.Advance(time.Minute)
+	<-clock.waiting
+	expectFired(t, fired, 0)
+
+	s.Add("b", mustSchedule(t, "*/5 * * * *"))
+	<-clock.waiting
+	upcoming := s.Upcoming("b", 3)
+	if len(upcoming) != 3 || !upcoming[0].Equal(at(5)) || !upcoming[2].Equal(at(15)) {
+		t.Errorf("upcoming %v", upcoming)
+	}
+	if err := s.Update("b", mustSchedule(t, "*/3 * * * *")); err != nil {
+		t.Fatal(err)
+	}
+	<-clock.waiting
+	clock.Advance(time.Minute)
+	<-clock.waiting
+	got := expectFired(t, fired, 1)
+	if got[0].name != "b" || !got[0].scheduledTime.Equal(at(3)) {
+		t.Errorf("fired %v", got)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	jitter := 20 * time.Second
+	s, clock, fired, stop := startScheduler(t, schedulerStart, map[string]*Schedule{
+		"a": mustSchedule(t, "* * * * *").WithJitter(jitter),
+	})
+	defer stop()
+
+	jittered := false
+	for minute := 1; minute <= 5; minute++ {
+		s.mu.Lock()
+		entry := s.entries["a"]
+		next, fireAt := entry.next, entry.fireAt
+		s.mu.Unlock()
+		if !next.Equal(at(minute)) || fireAt.Before(next) || !fireAt.Before(next.Add(jitter)) {
+			t.Fatalf("next %s fires at %s, beyond the jitter", next, fireAt)
+		}
+		jittered = jittered || fireAt.After(next)
+
+		// the heartbeat wakes the scheduler up on the way
+		for clock.Now().Add(HeartbeatInterval).Before(fireAt) {
+			clock.Advance(HeartbeatInterval)
+			<-clock.waiting
+		}
+		if delay := fireAt.Sub(clock.Now()); delay > time.Second {
+			clock.Advance(delay - time.Second)
+			expectFired(t, fired, 0)
+		}
+		clock.Advance(fireAt.Sub(clock.Now()))
+		<-clock.waiting
+		got := expectFired(t, fired, 1)
+		if !got[0].scheduledTime.Equal(next) {
+			t.Errorf("scheduled time %s, want %s without the jitter", got[0].scheduledTime, next)
+		}
+	}
+	if !jittered {
+		t.Error("no fire time was delayed")
+	}
+	if !s.LastTick().Equal(clock.Now()) {
+		t.Errorf("last tick %s, now %s", s.LastTick(), clock.Now())
+	}
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"reflect"
+	"time"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// schemaEnums are the values allowed for the keys of the config taking one
+// of a fixed set, by type and key. The job types are those an executor is
+// registered for, added when generating the schema.
+var schemaEnums = map[string][]string{
+	"Job.catchup":         {CatchupNone, CatchupLast, CatchupAll},
+	"Job.mode":            {ModeReplicated, ModeGlobal},
+	"JobOutput.from":      {OutputFromLastLine, OutputFromJson, OutputFromFile},
+	"SinkConfig.type":     {SinkTypeFile, SinkTypeSyslog, SinkTypeHttp},
+	"SinkConfig.protocol": {"udp", "tcp"},
+	"SinkConfig.format":   {SinkFormatGelf, SinkFormatLoki},
+	"Webhook.on":          {EventSuccess, EventFailure, EventTimeout, EventRecovered},
+	"Email.on":            {EventSuccess, EventFailure, EventTimeout, EventRecovered},
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	envListType  = reflect.TypeOf(EnvList{})
+)
+
+// JsonSchema returns a JSON Schema of the config, generated from the keys of
+// Config and of the types it is made of, each struct being a definition.
+func JsonSchema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	schema := structSchema(reflect.TypeOf(Config{}), definitions)
+	schema["$schema"] = schemaDraft
+	schema["title"] = "docker-executor config"
+	schema["definitions"] = definitions
+	return schema
+}
+
+// schemaOf returns the schema of a value of type t, given as the enum key
+// of its parent, adding the structs it is made of to the definitions.
+func schemaOf(t reflect.Type, enum string, definitions map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case durationType:
+		return map[string]interface{}{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	case envListType:
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": []string{"string", "number", "boolean", "null"}}},
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			definitions[t.Name()] = nil
+			definitions[t.Name()] = structSchema(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), enum, definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), "", definitions)}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		schema := map[string]interface{}{"type": "string"}
+		if enum == "Job.type" {
+			schema["enum"] = JobTypes()
+		} else if values, ok := schemaEnums[enum]; ok {
+			schema["enum"] = values
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of a struct, whose properties are its
+// fields with a yaml key.
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := yamlKey(f)
+		if name == "" {
+			continue
+		}
+		properties[name] = schemaOf(f.Type, t.Name()+"."+name, definitions)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
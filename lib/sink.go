@@ -0,0 +1,479 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SinkTypeFile   = "file"
+	SinkTypeSyslog = "syslog"
+	SinkTypeHttp   = "http"
+
+	SinkFormatGelf = "gelf"
+	SinkFormatLoki = "loki"
+
+	defaultSinkMaxSize  = 10 * 1024 * 1024
+	defaultSinkMaxFiles = 5
+
+	sinkTimeout = 10 * time.Second
+
+	// shipBatchLines and shipBatchDelay bound how many lines are shipped at
+	// once, and how long a line waits for others to be shipped with.
+	shipBatchLines = 100
+	shipBatchDelay = time.Second
+
+	// syslogPriority is the facility user (1) with severity informational (6).
+	syslogPriority = 1*8 + 6
+	// syslogEnterpriseId is the enterprise number in the structured data
+	// identifier, the one reserved for documentation.
+	syslogEnterpriseId = 32473
+	syslogAppName      = "docker-executor"
+)
+
+// SinkConfig configures where the output of the runs is shipped: a file per
+// job rotated by size, a syslog server or an http endpoint accepting GELF or
+// Loki pushes.
+type SinkConfig struct {
+	Type     string            `yaml:"type"`
+	Path     string            `yaml:"path"`
+	MaxSize  int64             `yaml:"max_size"`
+	MaxFiles int               `yaml:"max_files"`
+	Address  string            `yaml:"address"`
+	Protocol string            `yaml:"protocol"`
+	Url      string            `yaml:"url"`
+	Format   string            `yaml:"format"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// Sink receives the lines of output of a run as they are read, in batches,
+// along with when they were output. Every line must be tagged with the job
+// and the run it belongs to.
+type Sink interface {
+	Write(run Run, at time.Time, lines []string) error
+}
+
+func validateSinks(sinks []SinkConfig) error {
+	for _, sink := range sinks {
+		switch sink.Type {
+		case SinkTypeFile:
+			if sink.Path == "" {
+				return errors.New("file sink path must not be empty")
+			}
+			if sink.MaxSize < 0 || sink.MaxFiles < 0 {
+				return errors.New("file sink max_size and max_files must not be negative")
+			}
+		case SinkTypeSyslog:
+			_, _, err := net.SplitHostPort(sink.Address)
+			if err != nil {
+				return errors.Wrap(err, "syslog sink address must be host:port")
+			}
+			if sink.Protocol != "" && sink.Protocol != "udp" && sink.Protocol != "tcp" {
+				return errors.Errorf("unknown syslog sink protocol %s, must be udp or tcp", sink.Protocol)
+			}
+		case SinkTypeHttp:
+			u, err := url.Parse(sink.Url)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return errors.Errorf("http sink url %s must be a valid http or https url", sink.Url)
+			}
+			if sink.Format != SinkFormatGelf && sink.Format != SinkFormatLoki {
+				return errors.Errorf("unknown http sink format %s, must be gelf or loki", sink.Format)
+			}
+		default:
+			return errors.Errorf("unknown sink type %s, must be file, syslog or http", sink.Type)
+		}
+	}
+	return nil
+}
+
+// NewSink creates the sink described by a validated configuration.
+func NewSink(config SinkConfig) Sink {
+	switch config.Type {
+	case SinkTypeFile:
+		return newFileSink(config)
+	case SinkTypeSyslog:
+		return newSyslogSink(config)
+	case SinkTypeHttp:
+		return newHttpSink(config)
+	}
+	return nil
+}
+
+// Shipper writes the output of the runs to the sinks configured globally and
+// for each job.
+type Shipper struct {
+	global []Sink
+	jobs   map[string][]Sink
+}
+
+func NewShipper(config *Config) *Shipper {
+	shipper := &Shipper{jobs: make(map[string][]Sink)}
+	for _, sink := range config.Sinks {
+		shipper.global = append(shipper.global, NewSink(sink))
+	}
+	for jobName, job := range config.Jobs {
+		for _, sink := range job.Sinks {
+			shipper.jobs[jobName] = append(shipper.jobs[jobName], NewSink(sink))
+		}
+	}
+	return shipper
+}
+
+// Stream returns a writer shipping the output of a run to its sinks as it is
+// written, line by line, in batches sent in the background. Closing it ships
+// what is left, including a last line without a newline.
+func (s *Shipper) Stream(run Run) io.WriteCloser {
+	sinks := append(append([]Sink{}, s.global...), s.jobs[run.JobName]...)
+	if len(sinks) == 0 {
+		return nopWriteCloser{ioutil.Discard}
+	}
+	stream := &shipStream{run: run, sinks: sinks, wake: make(chan struct{}, 1)}
+	go stream.ship()
+	return stream
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type shipBatch struct {
+	at    time.Time
+	lines []string
+}
+
+// shipStream splits the output of a run into lines, batched until there are
+// enough of them or the first one waited long enough, and queued for the
+// sinks. The queue is not bounded, so that a slow sink never holds the run
+// back.
+type shipStream struct {
+	run     Run
+	sinks   []Sink
+	mu      sync.Mutex
+	partial []byte
+	lines   []string
+	timer   *time.Timer
+	queue   []shipBatch
+	closed  bool
+	wake    chan struct{}
+}
+
+func (s *shipStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partial = append(s.partial, p...)
+	i := bytes.LastIndexByte(s.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	for _, line := range strings.Split(string(s.partial[:i]), "\n") {
+		s.lines = append(s.lines, printable(line))
+	}
+	s.partial = append([]byte{}, s.partial[i+1:]...)
+	if len(s.lines) >= shipBatchLines {
+		s.flush()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(shipBatchDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.flush()
+		})
+	}
+	return len(p), nil
+}
+
+func (s *shipStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.partial) > 0 {
+		s.lines = append(s.lines, printable(string(s.partial)))
+		s.partial = nil
+	}
+	s.flush()
+	s.closed = true
+	s.signal()
+	return nil
+}
+
+// flush queues the batched lines.
+func (s *shipStream) flush() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.lines) == 0 {
+		return
+	}
+	s.queue = append(s.queue, shipBatch{at: time.Now(), lines: s.lines})
+	s.lines = nil
+	s.signal()
+}
+
+func (s *shipStream) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ship writes the queued batches to the sinks, in order, until the stream is
+// closed and the queue empty.
+func (s *shipStream) ship() {
+	for range s.wake {
+		s.mu.Lock()
+		queue, closed := s.queue, s.closed
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, batch := range queue {
+			var wg sync.WaitGroup
+			for _, sink := range s.sinks {
+				wg.Add(1)
+				go func(sink Sink) {
+					defer wg.Done()
+					err := sink.Write(s.run, batch.at, batch.lines)
+					if err != nil {
+						logrus.WithFields(logrus.Fields{"job": s.run.JobName, "run_id": s.run.ID}).WithError(err).Error("unable to ship job output")
+					}
+				}(sink)
+			}
+			wg.Wait()
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// fileSink appends the lines to a file per job, named after it, rotating it
+// when it grows beyond the maximum size.
+type fileSink struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+}
+
+func newFileSink(config SinkConfig) *fileSink {
+	sink := &fileSink{dir: config.Path, maxSize: config.MaxSize, maxFiles: config.MaxFiles}
+	if sink.maxSize == 0 {
+		sink.maxSize = defaultSinkMaxSize
+	}
+	if sink.maxFiles == 0 {
+		sink.maxFiles = defaultSinkMaxFiles
+	}
+	return sink
+}
+
+func (s *fileSink) Write(run Run, at time.Time, lines []string) error {
+	var buf bytes.Buffer
+	timestamp := at.UTC().Format(time.RFC3339Nano)
+	for _, line := range lines {
+		fmt.Fprintf(&buf, "%s job=%s run_id=%s %s\n", timestamp, run.JobName, run.ID, line)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(s.dir, run.JobName+".log")
+	info, err := os.Stat(filename)
+	if err == nil && info.Size() > 0 && info.Size()+int64(buf.Len()) > s.maxSize {
+		err = s.rotate(filename)
+		if err != nil {
+			return errors.Wrapf(err, "unable to rotate %s", filename)
+		}
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotate shifts file.1 to file.2 and so on, dropping the oldest, and moves
+// the file to file.1.
+func (s *fileSink) rotate(filename string) error {
+	err := os.Remove(filename + "." + strconv.Itoa(s.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(filename+"."+strconv.Itoa(i), filename+"."+strconv.Itoa(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(filename, filename+".1")
+}
+
+// syslogSink sends the lines as RFC5424 messages, tagged with structured
+// data, over udp or over tcp with octet counting framing.
+type syslogSink struct {
+	address  string
+	protocol string
+	hostname string
+}
+
+func newSyslogSink(config SinkConfig) *syslogSink {
+	sink := &syslogSink{address: config.Address, protocol: config.Protocol, hostname: "-"}
+	if sink.protocol == "" {
+		sink.protocol = "udp"
+	}
+	hostname, err := os.Hostname()
+	if err == nil && hostname != "" {
+		sink.hostname = hostname
+	}
+	return sink
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func (s *syslogSink) message(run Run, at time.Time, line string) string {
+	return fmt.Sprintf("<%d>1 %s %s %s - - [run@%d job=\"%s\" run_id=\"%s\"] %s",
+		syslogPriority,
+		at.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.hostname,
+		syslogAppName,
+		syslogEnterpriseId,
+		syslogParamEscaper.Replace(run.JobName),
+		syslogParamEscaper.Replace(run.ID),
+		line,
+	)
+}
+
+func (s *syslogSink) Write(run Run, at time.Time, lines []string) error {
+	conn, err := net.DialTimeout(s.protocol, s.address, sinkTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+
+	for _, line := range lines {
+		msg := s.message(run, at, line)
+		if s.protocol == "tcp" {
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// httpSink pushes the lines to a GELF http input, one message per line, or
+// to the Loki push API, one stream per run.
+type httpSink struct {
+	url      string
+	format   string
+	labels   map[string]string
+	hostname string
+	client   *http.Client
+}
+
+func newHttpSink(config SinkConfig) *httpSink {
+	sink := &httpSink{
+		url:    config.Url,
+		format: config.Format,
+		labels: config.Labels,
+		client: &http.Client{Timeout: sinkTimeout},
+	}
+	sink.hostname, _ = os.Hostname()
+	return sink
+}
+
+func (s *httpSink) Write(run Run, at time.Time, lines []string) error {
+	if s.format == SinkFormatLoki {
+		return s.post(lokiPush(run, at, lines, s.labels))
+	}
+	for _, line := range lines {
+		err := s.post(gelfMessage(run, at, line, s.hostname, s.labels))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gelfMessage(run Run, at time.Time, line string, hostname string, labels map[string]string) map[string]interface{} {
+	msg := map[string]interface{}{
+		"version":       "1.1",
+		"host":          hostname,
+		"short_message": line,
+		"timestamp":     float64(at.UnixNano()) / float64(time.Second),
+		"level":         6,
+	}
+	for key, value := range labels {
+		msg["_"+key] = value
+	}
+	msg["_job"] = run.JobName
+	msg["_run_id"] = run.ID
+	return msg
+}
+
+// lokiPush tags the stream with the job, and every line with the run, which
+// is kept out of the labels as it would create a stream per run. Lines are a
+// nanosecond apart to keep their order.
+func lokiPush(run Run, at time.Time, lines []string, labels map[string]string) map[string]interface{} {
+	stream := map[string]string{}
+	for key, value := range labels {
+		stream[key] = value
+	}
+	stream["job"] = run.JobName
+
+	values := make([][]string, len(lines))
+	timestamp := at.UnixNano()
+	for i, line := range lines {
+		values[i] = []string{strconv.FormatInt(timestamp+int64(i), 10), "run_id=" + run.ID + " " + line}
+	}
+	return map[string]interface{}{
+		"streams": []interface{}{
+			map[string]interface{}{"stream": stream, "values": values},
+		},
+	}
+}
+
+func (s *httpSink) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.Errorf("sink responded %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const maxRunsPerJob = 100
+
+type state struct {
+	LastFire map[string]time.Time
+	Paused   map[string]bool
+	Runs     map[string][]Run
+}
+
+// Store keeps the state of the jobs across restarts, in a json file. A store
+// without a file only lives in memory.
+type Store struct {
+	mu       sync.RWMutex
+	filename string
+	state    state
+}
+
+func NewStore(filename string) (*Store, error) {
+	store := &Store{
+		filename: filename,
+		state: state{
+			LastFire: make(map[string]time.Time),
+			Paused:   make(map[string]bool),
+			Runs:     make(map[string][]Run),
+		},
+	}
+	if filename == "" {
+		return store, nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read state file %s", filename)
+	}
+	err = json.Unmarshal(content, &store.state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decode state file %s", filename)
+	}
+	if store.state.LastFire == nil {
+		store.state.LastFire = make(map[string]time.Time)
+	}
+	if store.state.Paused == nil {
+		store.state.Paused = make(map[string]bool)
+	}
+	if store.state.Runs == nil {
+		store.state.Runs = make(map[string][]Run)
+	}
+	return store, nil
+}
+
+// save writes the state to a temporary file, then renames it over the state
+// file, so that a crash never leaves it half written. It must be called with
+// the lock held.
+func (s *Store) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	content, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "unable to write state file")
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "unable to write state file")
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
+
+// CheckWritable checks that the state file can be written, by creating a
+// temporary file next to it.
+func (s *Store) CheckWritable() error {
+	if s.filename == "" {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".check")
+	if err != nil {
+		return errors.Wrap(err, "state file not writable")
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// LastFire returns the last time a job was fired by the scheduler.
+func (s *Store) LastFire(jobName string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.state.LastFire[jobName]
+	return t, ok
+}
+
+func (s *Store) SetLastFire(jobName string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.state.LastFire[jobName]; ok && !t.After(last) {
+		return nil
+	}
+	s.state.LastFire[jobName] = t
+	return s.save()
+}
+
+// Paused returns whether a job was paused or resumed through the API, and if
+// so, which of the two.
+func (s *Store) Paused(jobName string) (paused bool, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	paused, ok = s.state.Paused[jobName]
+	return paused, ok
+}
+
+func (s *Store) SetPaused(jobName string, paused bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Paused[jobName] = paused
+	return s.save()
+}
+
+// AddRun records a run, keeping only the most recent ones of every job, and
+// returns the runs dropped to make room for it.
+func (s *Store) AddRun(run Run) (dropped []Run, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := append(s.state.Runs[run.JobName], run)
+	if len(runs) > maxRunsPerJob {
+		dropped = append(dropped, runs[:len(runs)-maxRunsPerJob]...)
+		runs = runs[len(runs)-maxRunsPerJob:]
+	}
+	s.state.Runs[run.JobName] = runs
+	return dropped, s.save()
+}
+
+// FindRun returns the recorded run with the given id, if any.
+func (s *Store) FindRun(id string) (Run, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, runs := range s.state.Runs {
+		for _, run := range runs {
+			if run.ID == id {
+				return run, true
+			}
+		}
+	}
+	return Run{}, false
+}
+
+// Runs returns the recorded runs of a job, oldest first.
+func (s *Store) Runs(jobName string) []Run {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Run{}, s.state.Runs[jobName]...)
+}
@@ -1,130 +1,222 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"github.com/sirupsen/logrus"
 	"github.com/docker/docker/client"
-	"github.com/gorhill/cronexpr"
 	"github.com/palicao/docker-executor/lib"
-	"log"
-	"net/http"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-	"unicode"
 	"flag"
 )
 
-type ApiResponse struct {
-	JobName   string
-	StartTime time.Time
-	EndTime   time.Time
-	Output    []string
+const usage = `Usage: docker-executor <command> [options]
+
+Commands:
+  serve          run the scheduler and the http API, the default
+  validate       check the config file, reporting every error
+  run <job>      run a job once and exit with its exit code
+  list           list the configured jobs
+  config         print the effective config, with defaults and templates applied
+  schema         print the JSON Schema of the config
+  next <job>     preview the upcoming fire times of a job
+  trigger <job>  run a job through a running daemon
+  logs <run>     print the full logs of a run, from a running daemon
+  history <job>  list the recent runs of a job, from a running daemon
+
+Run docker-executor <command> -h for the options of a command.
+`
+
+// fallbackApiVersion is the docker API version used when the daemon can't be
+// reached to negotiate it.
+const fallbackApiVersion = "1.31"
+
+var commands = map[string]func(args []string) int{
+	"serve":    serve,
+	"validate": validate,
+	"run":      runOnce,
+	"list":     list,
+	"config":   showConfig,
+	"schema":   schema,
+	"next":     next,
+	"trigger":  trigger,
+	"logs":     logs,
+	"history":  history,
 }
 
 func main() {
-	configFile := flag.String("config", "./config.yaml", "specify the yaml config file location")
-	flag.Parse()
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	cmd, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	os.Exit(cmd(args))
+}
 
-	config, err := lib.GetConfigFromFile(*configFile)
-	if err != nil {
-		log.Fatalf("error reading config: %v", err)
+// newCommand returns the flag set of a command, printing the usage of the
+// command followed by its options.
+func newCommand(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		if name == "serve" {
+			fmt.Fprint(os.Stderr, usage+"\n")
+		}
+		fmt.Fprintf(os.Stderr, "Usage: docker-executor %s [options] %s\n\nOptions:\n", name, args)
+		fs.PrintDefaults()
 	}
+	return fs
+}
+
+// parseCommand parses the options of a command, which can come before or
+// after its arguments, and exits when the number of arguments is wrong.
+func parseCommand(fs *flag.FlagSet, args []string, n int) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != n {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return positional
+}
 
-	cli, err := client.NewEnvClient()
+// newDockerClient creates a docker client configured by the environment,
+// talking the highest API version both the client and the daemon support.
+func newDockerClient() (*client.Client, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
-		log.Fatalf("error creating client: %v", err)
+		return nil, err
 	}
 
-	api := lib.NewDockerApi(cli)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ping, err := cli.Ping(ctx)
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to negotiate the docker API version, using %s", fallbackApiVersion)
+		ping.APIVersion = fallbackApiVersion
+	}
+	cli.NegotiateAPIVersionPing(ping)
+	logrus.WithField("api_version", cli.ClientVersion()).Debug("docker client created")
+	return cli, nil
+}
 
-	done := make(chan bool)
-	go startServer(config, api, done)
-	go scheduleJobs(config, api, done)
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "./config.yaml", "specify the config file (yaml, json or toml), directory or glob")
+}
 
-	<-done
+func loggingFlags(fs *flag.FlagSet) (level *string, format *string) {
+	level = fs.String("log-level", "info", "log level: debug, info, warn or error")
+	format = fs.String("log-format", "text", "log format: text or json")
+	return level, format
 }
 
-func scheduleJobs(config *lib.Config, api *lib.DockerApi, done chan bool) {
-	var wg sync.WaitGroup
-	for _, job := range config.Jobs {
-		if job.Schedule != "" {
-			scheduleJob(job, api, &wg)
-		}
+// serve runs the scheduler and the http API until terminated.
+func serve(args []string) int {
+	fs := newCommand("serve", "")
+	configFile := configFlag(fs)
+	logLevel, logFormat := loggingFlags(fs)
+	parseCommand(fs, args, 0)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid logging options")
 	}
-	wg.Wait()
-	done <- true
-}
 
-func startServer(config *lib.Config, api *lib.DockerApi, done chan bool) {
-	for jobName, job := range config.Jobs {
-		if job.ApiExpose == true {
-			http.HandleFunc("/jobs/run/"+jobName, func(w http.ResponseWriter, r *http.Request) {
-
-				startTime := time.Now()
-				response := runJob(job, api)
-				endTime := time.Now()
-
-				res := ApiResponse{
-					JobName:   jobName,
-					StartTime: startTime,
-					EndTime:   endTime,
-					Output:    prepareOutput(response),
-				}
-
-				js, err := json.Marshal(res)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				w.Write(js)
-			})
-		}
+	config, err := lib.GetConfigFromFile(*configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("error reading config")
 	}
-	err := http.ListenAndServe(":8080", nil)
+
+	output, err := openJobOutput(config.JobOutput)
 	if err != nil {
-		log.Fatalf("error starting http server: %v", err)
+		logrus.WithError(err).Fatal("error opening job output")
 	}
-	done <- true
-}
 
-func prepareOutput(in []byte) []string {
-	s := strings.Map(func(r rune) rune {
-		if unicode.IsPrint(r) || unicode.IsSpace(r) {
-			return r
-		}
-		return -1
-	}, string(in))
-	return strings.Split(strings.Trim(s, "\n"), "\n")
-}
+	cli, err := newDockerClient()
+	if err != nil {
+		logrus.WithError(err).Fatal("error creating client")
+	}
 
-func runJob(job lib.Job, api *lib.DockerApi) []byte {
-	fmt.Printf("running job %s\n", time.Now().Format("15:04:05"))
-	if job.Type == lib.JobTypeRun {
-		response, err := api.RunJobAsContainer(job)
-		if err != nil {
-			log.Fatalf("error running container: %v", err)
-		}
-		return response
-	} else {
-		response, err := api.RunJobAsService(job)
-		if err != nil {
-			log.Fatalf("error running service: %v", err)
-		}
-		return response
+	store, err := lib.NewStore(config.StateFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("error reading state")
 	}
-}
 
-func scheduleJob(job lib.Job, api *lib.DockerApi, wg *sync.WaitGroup) {
-	nextTime := cronexpr.MustParse(job.Schedule).Next(time.Now())
-	wg.Add(1)
+	runner := newRunner(config, lib.NewDockerApi(cli), store, output)
+
+	scheduler := lib.NewScheduler(lib.SystemClock, runner.Fire)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	done := make(chan bool)
+	go startServer(&Server{runner: runner, scheduler: scheduler}, done)
+	runner.CatchUp(time.Now())
+	syncSchedules(scheduler, nil, config)
+	go newConfigWatcher(*configFile, runner, scheduler).Run(ctx)
 	go func() {
-		time.Sleep(nextTime.Sub(time.Now()))
-		scheduleJob(job, api, wg)
-		response := runJob(job, api)
-		fmt.Println(string(response))
-		wg.Done()
+		scheduler.Run(ctx)
+		done <- true
 	}()
+
+	<-done
+	return 0
+}
+
+// setupLogging configures the level and format of the logs of the executor.
+// Logs always go to stderr, keeping them apart from the output of the jobs.
+func setupLogging(level string, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	logrus.SetOutput(os.Stderr)
+
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %s, must be text or json", format)
+	}
+	return nil
+}
+
+// openJobOutput returns where the output of the jobs is written: stdout (the
+// default), stderr, none to discard it, or the path of a file it is appended
+// to.
+func openJobOutput(output string) (io.Writer, error) {
+	switch output {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "none":
+		return ioutil.Discard, nil
+	}
+	return os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 }
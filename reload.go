@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/palicao/docker-executor/lib"
+	"github.com/sirupsen/logrus"
+)
+
+const reloadInterval = 5 * time.Second
+
+// syncSchedules schedules the jobs of a configuration, rescheduling the ones
+// whose schedule changed since the previous one, if any, and unscheduling the
+// ones no longer scheduled.
+func syncSchedules(scheduler *lib.Scheduler, previous *lib.Config, config *lib.Config) {
+	for _, scheduled := range scheduler.Jobs() {
+		if config.Jobs[scheduled.Name].Schedule == "" {
+			scheduler.Remove(scheduled.Name)
+		}
+	}
+
+	for _, jobName := range config.JobNames() {
+		job := config.Jobs[jobName]
+		if job.Schedule == "" {
+			continue
+		}
+		if previous != nil {
+			old, ok := previous.Jobs[jobName]
+			if ok && old.Schedule == job.Schedule && old.Timezone == job.Timezone && old.Jitter == job.Jitter {
+				continue
+			}
+		}
+
+		schedule, err := job.GetSchedule()
+		if err != nil {
+			logrus.WithField("job", jobName).WithError(err).Error("error scheduling job")
+			continue
+		}
+		if scheduler.Update(jobName, schedule) != nil {
+			scheduler.Add(jobName, schedule)
+		}
+	}
+}
+
+// configWatcher reloads the configuration when any of its files changes, or
+// when a SIGHUP is received, and applies it to the runner and the scheduler.
+type configWatcher struct {
+	path      string
+	runner    *Runner
+	scheduler *lib.Scheduler
+	mtimes    map[string]time.Time
+}
+
+func newConfigWatcher(path string, runner *Runner, scheduler *lib.Scheduler) *configWatcher {
+	w := &configWatcher{path: path, runner: runner, scheduler: scheduler}
+	w.mtimes = w.stat()
+	return w
+}
+
+// stat returns the modification time of the files of the current
+// configuration, and of the files now matching the config path.
+func (w *configWatcher) stat() map[string]time.Time {
+	files := append([]string{}, w.runner.Config().Files...)
+	matching, err := lib.ConfigFiles(w.path)
+	if err == nil {
+		files = append(files, matching...)
+	}
+
+	mtimes := map[string]time.Time{}
+	for _, filename := range files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			mtimes[filename] = time.Time{}
+			continue
+		}
+		mtimes[filename] = info.ModTime()
+	}
+	return mtimes
+}
+
+// changed returns the files added, removed or modified since the last check.
+func (w *configWatcher) changed() []string {
+	mtimes := w.stat()
+	var changed []string
+	for filename, mtime := range mtimes {
+		previous, ok := w.mtimes[filename]
+		if !ok || !previous.Equal(mtime) {
+			changed = append(changed, filename)
+		}
+	}
+	for filename := range w.mtimes {
+		if _, ok := mtimes[filename]; !ok {
+			changed = append(changed, filename)
+		}
+	}
+	w.mtimes = mtimes
+	sort.Strings(changed)
+	return changed
+}
+
+// Run checks the files for changes until the context is cancelled.
+func (w *configWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			w.changed()
+			w.reload(logrus.WithField("signal", "SIGHUP"))
+		case <-ticker.C:
+			changed := w.changed()
+			if len(changed) > 0 {
+				w.reload(logrus.WithField("files", strings.Join(changed, ", ")))
+			}
+		}
+	}
+}
+
+// reload applies the configuration if it is valid, keeping the current one
+// otherwise.
+func (w *configWatcher) reload(logger *logrus.Entry) {
+	config, err := lib.GetConfigFromFile(w.path)
+	if errs, ok := err.(lib.ConfigErrors); ok {
+		for _, e := range errs {
+			logger.WithError(e).Error("invalid configuration")
+		}
+		logger.Error("configuration not reloaded")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("configuration not reloaded")
+		return
+	}
+
+	previous := w.runner.Config()
+	if config.StateFile != previous.StateFile || config.LogsDir != previous.LogsDir || config.JobOutput != previous.JobOutput {
+		logger.Warn("state_file, logs_dir and job_output are only applied on restart")
+	}
+	w.runner.SetConfig(config)
+	syncSchedules(w.scheduler, previous, config)
+	w.mtimes = w.stat()
+	logger.WithField("jobs", len(config.Jobs)).Info("configuration reloaded")
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/palicao/docker-executor/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Runner runs the configured jobs, recording their runs and handing their
+// outputs over to the jobs declared to run after them. Its configuration can
+// be replaced while running.
+type Runner struct {
+	configMu sync.RWMutex
+	config   *lib.Config
+	notifier *lib.Notifier
+	shipper  *lib.Shipper
+	api      *lib.DockerApi
+	outputs  *lib.Outputs
+	store    *lib.Store
+	logs     *lib.LogDir
+	output   io.Writer
+	outputMu sync.Mutex
+	mu       sync.Mutex
+	running  map[string]int
+}
+
+func newRunner(config *lib.Config, api *lib.DockerApi, store *lib.Store, output io.Writer) *Runner {
+	var logs *lib.LogDir
+	if config.LogsDir != "" {
+		logs = lib.NewLogDir(config.LogsDir)
+	}
+	return &Runner{
+		config:   config,
+		api:      api,
+		outputs:  lib.NewOutputs(),
+		store:    store,
+		notifier: lib.NewNotifier(config),
+		shipper:  lib.NewShipper(config),
+		logs:     logs,
+		output:   output,
+		running:  make(map[string]int),
+	}
+}
+
+// Config returns the current configuration.
+func (r *Runner) Config() *lib.Config {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.config
+}
+
+// SetConfig replaces the configuration, for the runs starting from now on.
+// The state file, logs dir and job output are kept.
+func (r *Runner) SetConfig(config *lib.Config) {
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+	r.config = config
+	r.notifier = lib.NewNotifier(config)
+	r.shipper = lib.NewShipper(config)
+}
+
+// Run runs a job and returns its record and the tail of its logs. The
+// whole output is streamed to the job output and to the sinks as it is read,
+// while the job runs for the executors following its logs. The jobs running
+// after it are started in the background once it succeeds.
+func (r *Runner) Run(jobName string, trigger string, scheduledTime time.Time) (*lib.Run, []byte, error) {
+	run := lib.NewRun(jobName, trigger, scheduledTime)
+	logger := logrus.WithFields(logrus.Fields{"job": jobName, "run_id": run.ID, "trigger": trigger})
+	logger.Info("running job")
+
+	r.configMu.RLock()
+	shipper, notifier := r.shipper, r.notifier
+	r.configMu.RUnlock()
+	stream := shipper.Stream(*run)
+	output := &lineWriter{mu: &r.outputMu, out: r.output}
+
+	r.setRunning(jobName, 1)
+	result, err := r.execute(lib.WithLogger(context.Background(), logger), jobName, run.ID, io.MultiWriter(output, stream))
+	r.setRunning(jobName, -1)
+	run.Finish(result, err)
+	stream.Close()
+	outputErr := output.Close()
+	if outputErr != nil {
+		logger.WithError(outputErr).Error("unable to write job output")
+	}
+
+	logger = logger.WithFields(logrus.Fields{"status": run.Status, "exit_code": run.ExitCode, "duration": run.Duration().String()})
+	if err != nil {
+		logger.WithError(err).Error("job failed")
+	} else {
+		logger.Info("job completed")
+	}
+
+	previous := r.previousRun(jobName)
+	r.addRun(*run, logger)
+	var logs []byte
+	if result != nil {
+		logs = result.Logs
+	}
+	notifier.Notify(*run, previous, logs)
+
+	if err != nil {
+		return run, nil, err
+	}
+
+	if run.Status == lib.RunStatusSuccess {
+		r.runAfter(jobName)
+	}
+
+	return run, result.Logs, nil
+}
+
+// addRun records a run, removing the full logs of the runs dropped from the
+// history.
+func (r *Runner) addRun(run lib.Run, logger *logrus.Entry) {
+	dropped, err := r.store.AddRun(run)
+	if err != nil {
+		logger.WithError(err).Error("unable to record run")
+	}
+	if r.logs == nil {
+		return
+	}
+	for _, d := range dropped {
+		err = r.logs.Remove(d.ID)
+		if err != nil {
+			logger.WithError(err).Warn("unable to remove logs of dropped run")
+		}
+	}
+}
+
+// OpenLogs opens the full logs of a run, kept when logs_dir is set.
+func (r *Runner) OpenLogs(runId string) (*os.File, error) {
+	if r.logs == nil {
+		return nil, os.ErrNotExist
+	}
+	return r.logs.Open(runId)
+}
+
+func (r *Runner) setRunning(jobName string, delta int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running[jobName] += delta
+}
+
+// IsRunning returns whether a job has runs in progress.
+func (r *Runner) IsRunning(jobName string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running[jobName] > 0
+}
+
+// LastRun returns the most recent run of a job, if any.
+func (r *Runner) LastRun(jobName string) *lib.Run {
+	runs := r.store.Runs(jobName)
+	if len(runs) == 0 {
+		return nil
+	}
+	return &runs[len(runs)-1]
+}
+
+// previousRun returns the last run of a job which was not skipped, if any.
+func (r *Runner) previousRun(jobName string) *lib.Run {
+	runs := r.store.Runs(jobName)
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Status != lib.RunStatusSkipped {
+			return &runs[i]
+		}
+	}
+	return nil
+}
+
+// execute runs a job, writing its whole output to stream as it is read.
+func (r *Runner) execute(ctx context.Context, jobName string, runId string, stream io.Writer) (*lib.JobResult, error) {
+	job, ok := r.Config().Jobs[jobName]
+	if !ok {
+		return nil, fmt.Errorf("unknown job %s", jobName)
+	}
+	job, err := r.outputs.Render(job)
+	if err != nil {
+		return nil, err
+	}
+
+	spill := stream
+	if r.logs != nil {
+		f, err := r.logs.Create(runId)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create log file")
+		}
+		defer f.Close()
+		spill = io.MultiWriter(f, stream)
+	}
+	capture := lib.NewCapture(job, spill)
+
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+
+	executor, err := lib.NewExecutor(job.Type, r.api)
+	if err != nil {
+		return nil, err
+	}
+	result, err := lib.RunJob(ctx, executor, job, capture)
+	if ctx.Err() == context.DeadlineExceeded {
+		return result, errors.Wrapf(ctx.Err(), "job timed out after %s", job.Timeout)
+	}
+	if err != nil {
+		return result, errors.Wrapf(err, "error running %s job", job.Type)
+	}
+
+	if job.Output != nil && result.ExitCode == 0 {
+		r.outputs.Set(jobName, result.Output)
+	}
+
+	return result, nil
+}
+
+func (r *Runner) runAfter(jobName string) {
+	for _, next := range r.Config().JobsAfter(jobName) {
+		go r.Run(next, lib.TriggerAfter, time.Time{})
+	}
+}
+
+// Fire runs a job fired by the scheduler, recording the fire time first so
+// that it is not caught up after a restart.
+func (r *Runner) Fire(jobName string, scheduledTime time.Time) {
+	err := r.store.SetLastFire(jobName, scheduledTime)
+	if err != nil {
+		logrus.WithField("job", jobName).WithError(err).Error("unable to record fire time")
+	}
+	r.runScheduled(jobName, lib.TriggerSchedule, scheduledTime)
+}
+
+// runScheduled runs a job fired by the scheduler, unless the job is paused,
+// in which case the run is recorded as skipped.
+func (r *Runner) runScheduled(jobName string, trigger string, scheduledTime time.Time) {
+	if !r.IsPaused(jobName) {
+		r.Run(jobName, trigger, scheduledTime)
+		return
+	}
+
+	run := lib.NewRun(jobName, trigger, scheduledTime)
+	run.Skip("job is paused")
+	logger := logrus.WithFields(logrus.Fields{"job": jobName, "run_id": run.ID, "trigger": trigger})
+	logger.Info("job is paused, skipping run")
+	r.addRun(*run, logger)
+}
+
+// IsPaused returns whether the scheduled runs of a job are skipped. Pausing
+// or resuming a job through the API overrides its suspended setting.
+func (r *Runner) IsPaused(jobName string) bool {
+	paused, ok := r.store.Paused(jobName)
+	if ok {
+		return paused
+	}
+	return r.Config().Jobs[jobName].Suspended
+}
+
+// SetPaused pauses or resumes the scheduled runs of a job.
+func (r *Runner) SetPaused(jobName string, paused bool) error {
+	if _, ok := r.Config().Jobs[jobName]; !ok {
+		return fmt.Errorf("unknown job %s", jobName)
+	}
+	return r.store.SetPaused(jobName, paused)
+}
+
+// CatchUp runs the fire times of the scheduled jobs missed while the daemon
+// was down, according to their catchup policy.
+func (r *Runner) CatchUp(now time.Time) {
+	for jobName, job := range r.Config().Jobs {
+		if job.Schedule == "" {
+			continue
+		}
+		lastFire, ok := r.store.LastFire(jobName)
+		if !ok {
+			continue
+		}
+		schedule, err := job.GetSchedule()
+		if err != nil {
+			logrus.WithField("job", jobName).WithError(err).Error("unable to catch up")
+			continue
+		}
+		missed := lib.MissedRuns(job, schedule, lastFire, now)
+		if len(missed) == 0 {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{"job": jobName, "missed": len(missed)}).Info("catching up missed runs")
+		err = r.store.SetLastFire(jobName, missed[len(missed)-1])
+		if err != nil {
+			logrus.WithField("job", jobName).WithError(err).Error("unable to record fire time")
+		}
+		go func(jobName string) {
+			for _, scheduledTime := range missed {
+				r.runScheduled(jobName, lib.TriggerCatchup, scheduledTime)
+			}
+		}(jobName)
+	}
+}
+
+// lineWriter writes to the job output, shared by the runs, whole lines only,
+// so that the lines of concurrent runs are not mixed up.
+type lineWriter struct {
+	mu      *sync.Mutex
+	out     io.Writer
+	partial []byte
+	err     error
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	w.write(w.partial[:i+1])
+	w.partial = append([]byte{}, w.partial[i+1:]...)
+	return len(p), nil
+}
+
+// Close writes the last line, if not ended with a newline, returning the
+// first error met writing to the output.
+func (w *lineWriter) Close() error {
+	if len(w.partial) > 0 {
+		w.write(w.partial)
+		w.partial = nil
+	}
+	return w.err
+}
+
+// write writes to the output, an error being kept for Close rather than
+// returned, for the output not to be what stops the job.
+func (w *lineWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, w.err = w.out.Write(p)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/palicao/docker-executor/lib"
+	"github.com/sirupsen/logrus"
+)
+
+const upcomingFireTimes = 5
+
+const maskedValue = "****"
+
+type ApiResponse struct {
+	JobName   string
+	StartTime time.Time
+	EndTime   time.Time
+	Output    []string
+	Truncated bool
+	Tasks     []lib.TaskRecord `json:",omitempty"`
+}
+
+type PauseResponse struct {
+	JobName string
+	Paused  bool
+}
+
+type RunResponse struct {
+	lib.Run
+	Duration string
+}
+
+type JobResponse struct {
+	Job      lib.Job
+	Paused   bool
+	Running  bool
+	NextRuns []time.Time
+	LastRun  *RunResponse
+}
+
+// Server serves the http API, for the current configuration of the runner.
+type Server struct {
+	runner    *Runner
+	scheduler *lib.Scheduler
+}
+
+func startServer(server *Server, done chan bool) {
+	http.HandleFunc("/jobs/run/", server.handleRunJob)
+	http.HandleFunc("/jobs", server.handleJobs)
+	http.HandleFunc("/jobs/", server.handleJob)
+	http.HandleFunc("/runs/", server.handleRun)
+	http.HandleFunc("/healthz", server.handleHealth)
+	http.HandleFunc("/readyz", server.handleReady)
+	http.HandleFunc("/version", server.handleVersion)
+	err := http.ListenAndServe(":8080", nil)
+	if err != nil {
+		logrus.WithError(err).Fatal("error starting http server")
+	}
+	done <- true
+}
+
+// handleRunJob serves /jobs/run/{name}, running the jobs exposed through the
+// API.
+func (s *Server) handleRunJob(w http.ResponseWriter, r *http.Request) {
+	jobName := strings.TrimPrefix(r.URL.Path, "/jobs/run/")
+	job, ok := s.runner.Config().Jobs[jobName]
+	if !ok || !job.ApiExpose {
+		http.NotFound(w, r)
+		return
+	}
+
+	startTime := time.Now()
+	run, response, err := s.runner.Run(jobName, lib.TriggerApi, time.Time{})
+	endTime := time.Now()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := ApiResponse{
+		JobName:   jobName,
+		StartTime: startTime,
+		EndTime:   endTime,
+		Output:    lib.PrepareOutput(response),
+		Truncated: run.Truncated,
+		Tasks:     run.Tasks,
+	}
+
+	writeJson(w, res)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	writeJsonStatus(w, http.StatusOK, v)
+}
+
+func writeJsonStatus(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// handleJobs serves GET /jobs.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := []JobResponse{}
+	for _, jobName := range s.runner.Config().JobNames() {
+		res = append(res, s.jobResponse(jobName))
+	}
+	writeJson(w, res)
+}
+
+// handleJob serves GET /jobs/{name} and /jobs/{name}/runs, POST
+// /jobs/{name}/pause and /jobs/{name}/resume, and POST /jobs/pause and
+// /jobs/resume for all the jobs at once.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	action := parts[len(parts)-1]
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if _, ok := s.runner.Config().Jobs[parts[0]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, s.jobResponse(parts[0]))
+	case len(parts) == 2 && action == "runs" && r.Method == http.MethodGet:
+		if _, ok := s.runner.Config().Jobs[parts[0]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		res := []RunResponse{}
+		for _, run := range s.runner.store.Runs(parts[0]) {
+			res = append(res, RunResponse{Run: run, Duration: run.Duration().String()})
+		}
+		writeJson(w, res)
+	case len(parts) > 2 || (action != "pause" && action != "resume"):
+		http.NotFound(w, r)
+	case r.Method != http.MethodPost:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case len(parts) == 2:
+		if _, ok := s.runner.Config().Jobs[parts[0]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		res, err := s.setPaused(parts[0], action == "pause")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, res)
+	default:
+		res := []PauseResponse{}
+		for _, jobName := range s.runner.Config().JobNames() {
+			pauseResponse, err := s.setPaused(jobName, action == "pause")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res = append(res, pauseResponse)
+		}
+		writeJson(w, res)
+	}
+}
+
+// handleRun serves GET /runs/{id}/logs, the full logs of a run, kept when
+// logs_dir is set.
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+	if len(parts) != 2 || parts[1] != "logs" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	run, ok := s.runner.store.FindRun(parts[0])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := s.runner.OpenLogs(run.ID)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, run.ID+".log", run.EndTime, f)
+}
+
+func (s *Server) setPaused(jobName string, paused bool) (PauseResponse, error) {
+	err := s.runner.SetPaused(jobName, paused)
+	if err != nil {
+		return PauseResponse{}, err
+	}
+	return PauseResponse{JobName: jobName, Paused: s.runner.IsPaused(jobName)}, nil
+}
+
+func (s *Server) jobResponse(jobName string) JobResponse {
+	res := JobResponse{
+		Job:      maskJob(s.runner.Config().Jobs[jobName]),
+		Paused:   s.runner.IsPaused(jobName),
+		Running:  s.runner.IsRunning(jobName),
+		NextRuns: s.scheduler.Upcoming(jobName, upcomingFireTimes),
+	}
+	lastRun := s.runner.LastRun(jobName)
+	if lastRun != nil {
+		res.LastRun = &RunResponse{Run: *lastRun, Duration: lastRun.Duration().String()}
+	}
+	return res
+}
+
+// maskJob hides the values of the env of a job and the secrets and headers of
+// its webhooks, which may hold credentials.
+func maskJob(job lib.Job) lib.Job {
+	env := make([]string, len(job.Env))
+	for i, e := range job.Env {
+		env[i] = e
+		if strings.Contains(e, "=") {
+			env[i] = strings.SplitN(e, "=", 2)[0] + "=" + maskedValue
+		}
+	}
+	job.Env = env
+
+	webhooks := make([]lib.Webhook, len(job.Notifications.Webhooks))
+	for i, webhook := range job.Notifications.Webhooks {
+		if webhook.Secret != "" {
+			webhook.Secret = maskedValue
+		}
+		headers := make(map[string]string, len(webhook.Headers))
+		for key := range webhook.Headers {
+			headers[key] = maskedValue
+		}
+		webhook.Headers = headers
+		webhooks[i] = webhook
+	}
+	job.Notifications.Webhooks = webhooks
+	return job
+}